@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// activityRecent is the number of recent requests kept for the dashboard.
+const activityRecent = 100
+
+// requestRecord describes a request answered by the cache.
+type requestRecord struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+	Result string    `json:"result"` // HIT, STALE, MISS, EXPIRED or REVALIDATE
+	Status int       `json:"status"`
+	Size   int64     `json:"size"` // content length of the response, -1 if unknown
+}
+
+// hostActivity counts the requests to a host answered by the cache.
+type hostActivity struct {
+	Requests int64 `json:"requests"`
+	Hits     int64 `json:"hits"`
+}
+
+// activityLog keeps the most recent requests and the number of requests per host since the start.
+type activityLog struct {
+	mu     sync.Mutex
+	recent []requestRecord // ring buffer of the last activityRecent requests
+	next   int             // position of the next record in recent
+	hosts  map[string]*hostActivity
+}
+
+// record adds a request answered with resp to the log.
+func (a *activityLog) record(req *http.Request, resp *http.Response, result string, hit bool) {
+	r := requestRecord{
+		Time:   time.Now(),
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Result: result,
+		Status: resp.StatusCode,
+		Size:   resp.ContentLength,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.recent) < activityRecent {
+		a.recent = append(a.recent, r)
+	} else {
+		a.recent[a.next] = r
+	}
+	a.next = (a.next + 1) % activityRecent
+
+	if a.hosts == nil {
+		a.hosts = make(map[string]*hostActivity)
+	}
+	host, ok := a.hosts[req.URL.Hostname()]
+	if !ok {
+		host = &hostActivity{}
+		a.hosts[req.URL.Hostname()] = host
+	}
+	host.Requests++
+	if hit {
+		host.Hits++
+	}
+}
+
+// snapshot returns the recent requests, the newest first, and a copy of the requests per host.
+func (a *activityLog) snapshot() ([]requestRecord, map[string]hostActivity) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	recent := make([]requestRecord, 0, len(a.recent))
+	for i := 1; i <= len(a.recent); i++ {
+		recent = append(recent, a.recent[(a.next-i+len(a.recent))%len(a.recent)])
+	}
+	hosts := make(map[string]hostActivity, len(a.hosts))
+	for name, host := range a.hosts {
+		hosts[name] = *host
+	}
+	return recent, hosts
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// adminEntry describes a cache entry in responses of the admin API.
+type adminEntry struct {
+	URL     string      `json:"url"`
+	Path    string      `json:"path"`             // path relative to the cache directory, without suffix
+	Size    int64       `json:"size"`             // size of metadata and body
+	Access  time.Time   `json:"access"`           // time of the last access
+	Expires time.Time   `json:"expires,omitzero"` // time the entry expires, zero if it never expires
+	Hits    int64       `json:"hits"`             // number of times the entry was read from the cache
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Stored  time.Time   `json:"stored,omitzero"` // time the response was stored or last revalidated
+	Age     int64       `json:"age,omitempty"`   // current age in seconds
+}
+
+// adminStats is the response of the stats endpoint of the admin API.
+type adminStats struct {
+	Size       int64 `json:"size"`        // current size of the cache
+	MaxSize    int64 `json:"max_size"`    // maximum size of the cache, 0 means unlimited
+	Entries    int   `json:"entries"`     // number of cached entries
+	DedupSaved int64 `json:"dedup_saved"` // size of bodies not stored again because they are shared by multiple entries
+	Inflight   int   `json:"inflight"`    // number of running downloads
+}
+
+// adminPurge is the response of a purge request of the admin API.
+type adminPurge struct {
+	Purged int   `json:"purged"` // number of removed entries
+	Freed  int64 `json:"freed"`  // freed bytes
+}
+
+// AdminHandler returns the handler of the admin API for inspecting and purging the cache:
+//
+//	GET    /             web dashboard
+//	GET    /api/dashboard metrics, top hosts, recent requests and running downloads shown on the dashboard
+//	GET    /api/stats    size and number of entries
+//	GET    /api/entries  entries filtered by the query parameters url, prefix, host and regex
+//	GET    /api/entry    entries with the URL of the query parameter url including their headers
+//	DELETE /api/entries  removes the entries filtered by the query parameters, at least one filter is required
+func (c *DiskCache) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", c.handleDashboard)
+	mux.HandleFunc("GET /api/dashboard", c.handleDashboardData)
+	mux.HandleFunc("GET /api/stats", c.handleStats)
+	mux.HandleFunc("GET /api/entries", c.handleEntries)
+	mux.HandleFunc("GET /api/entry", c.handleEntry)
+	mux.HandleFunc("DELETE /api/entries", c.handlePurge)
+	return mux
+}
+
+// size returns the current size of the cache. It is only tracked in currSize if the size is limited.
+func (c *DiskCache) size() int64 {
+	if c.config().MaxSize > 0 {
+		return c.currSize.Load()
+	}
+	return c.index.totalSize()
+}
+
+// entryFilter returns a function matching the index entries selected by the query parameters url (exact URL),
+// prefix (URL prefix), host and regex (regular expression matched against the URL). All given filters must match.
+// Returns false if no filter is given.
+func entryFilter(query url.Values) (func(e *indexEntry) bool, bool, error) {
+	exact, prefix, host := query.Get("url"), query.Get("prefix"), query.Get("host")
+	var re *regexp.Regexp
+	if pattern := query.Get("regex"); pattern != "" {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, false, err
+		}
+	}
+
+	match := func(e *indexEntry) bool {
+		if exact != "" && e.Key != exact {
+			return false
+		}
+		if prefix != "" && !strings.HasPrefix(e.Key, prefix) {
+			return false
+		}
+		if host != "" {
+			u, err := url.Parse(e.Key)
+			if err != nil || !strings.EqualFold(u.Hostname(), host) {
+				return false
+			}
+		}
+		return re == nil || re.MatchString(e.Key)
+	}
+	return match, exact != "" || prefix != "" || host != "" || re != nil, nil
+}
+
+// findEntries returns the index entries selected by the query parameters sorted by URL.
+func (c *DiskCache) findEntries(w http.ResponseWriter, r *http.Request, required bool) ([]indexEntry, bool) {
+	match, ok, err := entryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if !ok && required {
+		http.Error(w, "one of the query parameters url, prefix, host or regex is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	entries := c.index.find(match)
+	slices.SortFunc(entries, func(a, b indexEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries, true
+}
+
+// newAdminEntry returns the description of the index entry e.
+func newAdminEntry(e *indexEntry) adminEntry {
+	return adminEntry{
+		URL:     e.Key,
+		Path:    e.Path,
+		Size:    e.Size + e.BodySize,
+		Access:  e.Access,
+		Expires: e.Expires,
+		Hits:    e.Hits,
+	}
+}
+
+// handleStats reports the size and number of entries of the cache.
+func (c *DiskCache) handleStats(w http.ResponseWriter, r *http.Request) {
+	entries, saved := c.index.stats()
+	c.downloadMu.Lock()
+	inflight := len(c.inflight)
+	c.downloadMu.Unlock()
+
+	writeJSON(w, adminStats{
+		Size:       c.size(),
+		MaxSize:    int64(c.config().MaxSize),
+		Entries:    entries,
+		DedupSaved: saved,
+		Inflight:   inflight,
+	})
+}
+
+// handleEntries lists the entries selected by the query parameters, limited by the query parameter limit.
+func (c *DiskCache) handleEntries(w http.ResponseWriter, r *http.Request) {
+	entries, ok := c.findEntries(w, r, false)
+	if !ok {
+		return
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		entries = entries[:min(limit, len(entries))]
+	}
+
+	list := make([]adminEntry, 0, len(entries))
+	for i := range entries {
+		list = append(list, newAdminEntry(&entries[i]))
+	}
+	writeJSON(w, list)
+}
+
+// handleEntry shows the entries of the URL given by the query parameter url including their headers.
+// A URL has multiple entries if the response varies on request headers.
+func (c *DiskCache) handleEntry(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("url") == "" {
+		http.Error(w, "query parameter url is required", http.StatusBadRequest)
+		return
+	}
+	entries, ok := c.findEntries(w, r, true)
+	if !ok {
+		return
+	}
+
+	list := make([]adminEntry, 0, len(entries))
+	for i := range entries {
+		e := newAdminEntry(&entries[i])
+		if entry, _, err := readEntry(c.index.abs(entries[i].Path)); err == nil {
+			e.Status = entry.StatusCode
+			e.Header = entry.Header
+			e.Stored = entry.Stored
+			e.Age = int64(entry.age() / time.Second)
+		}
+		list = append(list, e)
+	}
+	if len(list) == 0 {
+		http.Error(w, "entry not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// handlePurge removes the entries selected by the query parameters.
+func (c *DiskCache) handlePurge(w http.ResponseWriter, r *http.Request) {
+	entries, ok := c.findEntries(w, r, true)
+	if !ok {
+		return
+	}
+
+	var result adminPurge
+	for _, e := range entries {
+		c.bodyMu.Lock()
+		freed := c.removeEntry(c.index.abs(e.Path))
+		c.subSize(freed)
+		c.bodyMu.Unlock()
+
+		result.Purged++
+		result.Freed += freed
+		if c.config().EnableLogging {
+			log.Printf("cache PURGE: %s", e.Key)
+		}
+	}
+	writeJSON(w, result)
+}
+
+// writeJSON writes v as JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("admin API: failed to write response: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// aptNamespace is the directory of apt repository entries of mirror groups configured in AptMirrors.
+const aptNamespace = "_apt"
+
+// aptKind is the type of apt repository file requested.
+type aptKind int
+
+const (
+	aptPool   aptKind = iota + 1 // package in pool/, never changes
+	aptByHash                    // index addressed by its hash in dists/.../by-hash/, never changes
+	aptIndex                     // index in dists/, e.g. InRelease or Packages.xz
+)
+
+// parseAptPath returns the type of the apt repository file with the given URL path.
+func parseAptPath(path string) (aptKind, bool) {
+	switch {
+	case strings.Contains(path, "/by-hash/"):
+		return aptByHash, true
+	case strings.Contains(path, "/pool/"):
+		return aptPool, true
+	case strings.Contains(path, "/dists/"):
+		return aptIndex, true
+	}
+	return 0, false
+}
+
+// aptKind returns the type of apt repository file requested with the URL, if apt mode is enabled and the host
+// is a mirror in AptMirrors. Other hosts keep the lifetimes of their responses.
+func (c *DiskCache) aptKind(u *url.URL) (aptKind, bool) {
+	if !c.config().AptMode {
+		return 0, false
+	}
+	if _, ok := c.aptMirror(u.Hostname()); !ok {
+		return 0, false
+	}
+	return parseAptPath(u.Path)
+}
+
+// aptMirror returns the mirror group of host configured in AptMirrors. Exact host names take precedence over
+// wildcards like "*.debian.org", the longest matching wildcard is used.
+func (c *DiskCache) aptMirror(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if group, ok := c.config().AptMirrors[host]; ok {
+		return group, true
+	}
+
+	var group, match string
+	for pattern, g := range c.config().AptMirrors {
+		suffix, ok := strings.CutPrefix(pattern, "*")
+		if ok && strings.HasSuffix(host, suffix) && len(suffix) > len(match) {
+			group, match = g, suffix
+		}
+	}
+	return group, match != ""
+}
+
+// aptKey returns the directory and the key of the cache entry for an apt repository request. Files of mirrors
+// in the same group share one namespace and are identified by their path only.
+func (c *DiskCache) aptKey(req *http.Request) (string, string, bool) {
+	if _, ok := c.aptKind(req.URL); !ok {
+		return "", "", false
+	}
+	group, ok := c.aptMirror(req.URL.Hostname())
+	if !ok {
+		return "", "", false
+	}
+	return filepath.Join(aptNamespace, group), req.Method + " " + req.URL.Path, true
+}
+
+// aptExpires sets the expiry of an apt repository file: packages and indexes addressed by hash never change,
+// other indexes are revalidated after AptIndexTTL. Returns false if the entry is no apt repository file.
+func (c *DiskCache) aptExpires(entry *cacheEntry) bool {
+	u, err := url.Parse(entry.URL)
+	if err != nil || entry.StatusCode != http.StatusOK {
+		return false
+	}
+	kind, ok := c.aptKind(u)
+	if !ok {
+		return false
+	}
+
+	entry.Expires = time.Time{}
+	if kind == aptIndex && c.config().AptIndexTTL > 0 {
+		entry.Expires = entry.Stored.Add(c.config().AptIndexTTL)
+	}
+	return true
+}
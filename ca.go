@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/gomitmproxy/proxyutil"
+)
+
+const (
+	caValidity   = 30 * 365 * 24 * time.Hour // validity of generated CA certificates
+	leafValidity = 365 * 24 * time.Hour      // validity of generated host certificates
+)
+
+// keyTypes are the supported values of CAKeyType.
+var keyTypes = []string{"rsa2048", "rsa3072", "rsa4096", "ecdsa-p256", "ecdsa-p384", "ed25519"}
+
+// generateKey generates a private key of the given type.
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+// keyID returns the subject key identifier of the public key (RFC 5280 section 4.2.1.2).
+func keyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
+
+// serialNumber returns a random serial number for a certificate.
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// loadOrCreateCA loads the CA certificate chain and key from CACert and CAKey. The first certificate of the chain
+// is the signing CA, followed by its issuers. If both files are missing, a new CA with a key of type CAKeyType is
+// generated and written to them.
+func loadOrCreateCA(config *Config) ([]*x509.Certificate, crypto.Signer, error) {
+	_, certErr := os.Stat(config.CACert)
+	_, keyErr := os.Stat(config.CAKey)
+	switch {
+	case os.IsNotExist(certErr) && os.IsNotExist(keyErr):
+		return createCA(config)
+	case os.IsNotExist(certErr):
+		return nil, nil, fmt.Errorf("CA key %s exists, but certificate %s is missing", config.CAKey, config.CACert)
+	case os.IsNotExist(keyErr):
+		return nil, nil, fmt.Errorf("CA certificate %s exists, but key %s is missing", config.CACert, config.CAKey)
+	}
+
+	chain, err := readCertificates(config.CACert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CA certificate: %w", err)
+	}
+	if err := verifyChain(chain); err != nil {
+		return nil, nil, fmt.Errorf("CA certificate %s: %w", config.CACert, err)
+	}
+	key, err := readPrivateKey(config.CAKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CA key: %w", err)
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(chain[0].PublicKey) {
+		return nil, nil, fmt.Errorf("CA key %s does not match certificate %s", config.CAKey, config.CACert)
+	}
+	return chain, key, nil
+}
+
+// createCA generates a new CA and writes its certificate and key to CACert and CAKey.
+func createCA(config *Config) ([]*x509.Certificate, crypto.Signer, error) {
+	log.Info("Generating new %s CA certificate and key...", config.CAKeyType)
+	key, err := generateKey(config.CAKeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := keyID(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"gitmproxy"},
+			CommonName:   "Gopher in the middle Root CA",
+		},
+		SubjectKeyId:          id,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            2,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(config.CAKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(config.CACert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+
+	log.Info("CA certificate %s and key %s generated.", config.CACert, config.CAKey)
+	return []*x509.Certificate{cert}, key, nil
+}
+
+// readCertificates reads all PEM encoded certificates of the file at path.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no PEM encoded certificate found", path)
+	}
+	return certs, nil
+}
+
+// verifyChain checks that the certificates of chain are CAs and each one is issued by the next.
+func verifyChain(chain []*x509.Certificate) error {
+	for i, cert := range chain {
+		if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+			return fmt.Errorf("%s is not a CA certificate", cert.Subject)
+		}
+		if i+1 < len(chain) {
+			if err := cert.CheckSignatureFrom(chain[i+1]); err != nil {
+				return fmt.Errorf("%s is not issued by %s: %w", cert.Subject, chain[i+1].Subject, err)
+			}
+		}
+	}
+	return nil
+}
+
+// selfSigned checks if cert is a root certificate.
+func selfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// readPrivateKey reads a PEM encoded private key in PKCS #8, PKCS #1 or SEC 1 format from the file at path.
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var block *pem.Block
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM encoded private key found", path)
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			break
+		}
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New(path + ": unsupported private key type")
+	}
+	return signer, nil
+}
+
+// certAuthority issues the host certificates of intercepted connections. It is used as certificate storage of
+// gomitmproxy, which only supports RSA CAs, and creates certificates for any key type on lookup.
+type certAuthority struct {
+	cert    *x509.Certificate   // signing CA, the root or an intermediate CA
+	chain   []*x509.Certificate // issuers of cert up to the root, if known
+	key     crypto.Signer
+	leafKey crypto.Signer // key shared by all host certificates
+	sent    [][]byte      // CA certificates sent in handshakes after the host certificate
+	store   *certStore    // nil if host certificates are not persisted
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// newCertAuthority loads or creates the CA of the configuration.
+func newCertAuthority(config *Config) (*certAuthority, error) {
+	chain, key, err := loadOrCreateCA(config)
+	if err != nil {
+		return nil, err
+	}
+	leafKey, err := generateKey(config.CAKeyType)
+	if err != nil {
+		return nil, err
+	}
+	a := &certAuthority{
+		cert:    chain[0],
+		chain:   chain[1:],
+		key:     key,
+		leafKey: leafKey,
+		certs:   make(map[string]*tls.Certificate),
+	}
+	if config.CertDir != "" {
+		if a.store, err = newCertStore(config.CertDir); err != nil {
+			return nil, fmt.Errorf("certificate store: %w", err)
+		}
+	}
+	// the root is known to clients, so it is not sent in handshakes
+	for _, cert := range chain {
+		if !selfSigned(cert) {
+			a.sent = append(a.sent, cert.Raw)
+		}
+	}
+
+	log.Info("CA: %s (%s), valid until %s", a.cert.Subject, a.cert.PublicKeyAlgorithm, a.cert.NotAfter.Format(time.DateOnly))
+	for _, cert := range a.chain {
+		log.Info("CA: issued by %s", cert.Subject)
+	}
+	if a.constrained() {
+		log.Info("CA: name constraints restrict intercepted hosts")
+	}
+	return a, nil
+}
+
+// root returns the certificate clients have to trust, which is the last known certificate of the chain.
+func (a *certAuthority) root() *x509.Certificate {
+	if len(a.chain) > 0 {
+		return a.chain[len(a.chain)-1]
+	}
+	return a.cert
+}
+
+// constrained checks if any CA of the chain has DNS or IP name constraints.
+func (a *certAuthority) constrained() bool {
+	for _, cert := range append([]*x509.Certificate{a.cert}, a.chain...) {
+		if len(cert.PermittedDNSDomains) > 0 || len(cert.ExcludedDNSDomains) > 0 ||
+			len(cert.PermittedIPRanges) > 0 || len(cert.ExcludedIPRanges) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// permits checks if the name constraints of the chain allow certificates for host (RFC 5280 section 4.2.1.10).
+// Certificates for other hosts would be rejected by clients, so their connections are not intercepted.
+func (a *certAuthority) permits(host string) bool {
+	ip := net.ParseIP(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, cert := range append([]*x509.Certificate{a.cert}, a.chain...) {
+		if ip != nil {
+			contains := func(ipNet *net.IPNet) bool { return ipNet.Contains(ip) }
+			if len(cert.PermittedIPRanges) > 0 && !slices.ContainsFunc(cert.PermittedIPRanges, contains) ||
+				slices.ContainsFunc(cert.ExcludedIPRanges, contains) {
+				return false
+			}
+			continue
+		}
+		match := func(domain string) bool { return matchDomainConstraint(domain, host) }
+		if len(cert.PermittedDNSDomains) > 0 && !slices.ContainsFunc(cert.PermittedDNSDomains, match) ||
+			slices.ContainsFunc(cert.ExcludedDNSDomains, match) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDomainConstraint checks if host matches a DNS name constraint. The constraint "example.com" matches the
+// domain and its subdomains, ".example.com" only subdomains.
+func matchDomainConstraint(constraint string, host string) bool {
+	constraint = strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint || strings.HasSuffix(host, "."+constraint)
+}
+
+// Get returns the certificate for host, hosts outside the name constraints are refused. Certificates are reused
+// from memory or the store until they are due for renewal, otherwise a new one is created.
+func (a *certAuthority) Get(host string) (*tls.Certificate, bool) {
+	// the SNI of a client may differ from the host of the CONNECT request checked before
+	if !a.permits(host) {
+		log.Error("CA: %s is not permitted by the name constraints", host)
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cert, ok := a.certs[host]; ok && a.usable(host, cert) {
+		return cert, true
+	}
+	if a.store != nil {
+		if cert, err := a.store.load(host); err == nil && a.usable(host, cert) {
+			// the stored certificate may be issued before the chain was changed
+			cert.Certificate = append(cert.Certificate[:1], a.sent...)
+			a.certs[host] = cert
+			return cert, true
+		}
+	}
+
+	start := time.Now()
+	cert, err := a.issue(host)
+	if err != nil {
+		log.Error("CA: creating certificate for %s: %s", host, err)
+		return nil, false
+	}
+	mCertGenerationSeconds.Observe(time.Since(start).Seconds())
+	a.set(host, cert)
+	return cert, true
+}
+
+// Set stores the certificate for host.
+func (a *certAuthority) Set(host string, cert *tls.Certificate) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.set(host, cert)
+}
+
+// set stores the certificate for host in memory and the store, the lock must be held.
+func (a *certAuthority) set(host string, cert *tls.Certificate) {
+	a.certs[host] = cert
+	if a.store != nil {
+		if err := a.store.save(host, cert); err != nil {
+			log.Error("CA: storing certificate for %s: %s", host, err)
+		}
+	}
+}
+
+// issue creates a certificate for host signed by the CA.
+func (a *certAuthority) issue(host string) (*tls.Certificate, error) {
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"gitmproxy"},
+			CommonName:   host,
+		},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(leafValidity),
+	}
+	if tmpl.NotAfter.After(a.cert.NotAfter) {
+		tmpl.NotAfter = a.cert.NotAfter
+	}
+	if _, ok := a.leafKey.(*rsa.PrivateKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, a.leafKey.Public(), a.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: append([][]byte{der}, a.sent...),
+		PrivateKey:  a.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// caResponse answers req with the root CA certificate, PEM encoded or DER encoded if der is set.
+func (a *certAuthority) caResponse(req *http.Request, der bool) *http.Response {
+	root := a.root()
+	body, contentType, name := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}),
+		"application/x-pem-file", "gitmproxy-ca.pem"
+	if der {
+		body, contentType, name = root.Raw, "application/x-x509-ca-cert", "gitmproxy-ca.crt"
+	}
+	resp := proxyutil.NewResponse(http.StatusOK, bytes.NewReader(body), req)
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	resp.ContentLength = int64(len(body))
+	return resp
+}
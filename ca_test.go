@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConstrainedCA writes an ECDSA CA permitted for example.com to dir and returns its configuration.
+func writeConstrainedCA(t *testing.T, dir string) *Config {
+	t.Helper()
+	key, err := generateKey("ecdsa-p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Constrained CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		PermittedDNSDomains:   []string{"example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		CACert:    filepath.Join(dir, "ca.crt"),
+		CAKey:     filepath.Join(dir, "ca.key"),
+		CAKeyType: "ecdsa-p256",
+	}
+	if err := os.WriteFile(config.CACert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.CAKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestMitmHostOutsideNameConstraints(t *testing.T) {
+	ca, err := newCertAuthority(writeConstrainedCA(t, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mitmConfig, err := initMitm(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ca.Get("evil.org"); ok {
+		t.Error("certificate issued for host outside the name constraints")
+	}
+	// the SNI of a client is not checked by the CONNECT handling, it must fail without a panic
+	if _, err := mitmConfig.GetOrCreateCert("evil.org"); err == nil {
+		t.Error("expected error for host outside the name constraints")
+	}
+
+	cert, err := mitmConfig.GetOrCreateCert("www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("www.example.com"); err != nil {
+		t.Error(err)
+	}
+}
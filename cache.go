@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bufio"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -19,18 +21,74 @@ import (
 	"github.com/pquerna/cachecontrol/cacheobject"
 )
 
+const (
+	metaSuffix = ".meta" // suffix of the file holding the cacheEntry
+	bodySuffix = ".body" // suffix of the file holding the response body
+	tmpSuffix  = ".tmp"  // suffix of files that are still written
+)
+
+// cacheEntry holds the status and headers of a cached response. It is stored as JSON next to the body file.
+type cacheEntry struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Stored     time.Time   `json:"stored"`           // time the response was stored or last revalidated
+	Expires    time.Time   `json:"expires,omitzero"` // time the entry becomes stale, zero if it never expires
+	Body       string      `json:"body,omitempty"`   // SHA-256 of the body in the body store, empty if stored next to the metadata
+
+	size int64  // size of the body file
+	path string // path of the entry, set by Get
+}
+
+// expired returns true if the entry is stale and has to be revalidated.
+func (e *cacheEntry) expired() bool {
+	return !e.Expires.IsZero() && time.Now().After(e.Expires)
+}
+
+// staleFor returns the time since the entry expired, zero if it never expires.
+func (e *cacheEntry) staleFor() time.Duration {
+	if e.Expires.IsZero() {
+		return 0
+	}
+	return time.Since(e.Expires)
+}
+
+// age returns the current age of the entry (RFC 9111 section 4.2.3).
+func (e *cacheEntry) age() time.Duration {
+	return initialAge(e.Header, e.Stored) + time.Since(e.Stored)
+}
+
+// response builds a http.Response for req from the entry with the given body.
+func (e *cacheEntry) response(req *http.Request, body io.ReadCloser, length int64) *http.Response {
+	return &http.Response{
+		StatusCode:    e.StatusCode,
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		ContentLength: length,
+		Body:          body,
+		Request:       req,
+	}
+}
+
 // DiskCache represents an HTTP response cache that stores entries on the file system, grouped by hostname.
-// It can enforce a maximum total disk usage (quota), a max response size for caching, and a cacheEntryTTL for cache entries.
+// It can enforce a maximum total disk usage (quota), a max response size for caching, and computes the freshness of
+// each entry from the server response with a cacheEntryTTL as fallback.
 type DiskCache struct {
-	config Config
+	conf atomic.Pointer[Config] // current configuration, replaced on reload
 
-	currSize  atomic.Int64 // tracked current size, updated on set/delete
-	sizeOnce  sync.Once
-	sizeError error
+	currSize atomic.Int64 // tracked current size, updated on set/delete
+	index    *cacheIndex  // persistent index of all entries used for eviction
+	tmpDir   string       // directory for files that are still written
+	bodyMu   sync.Mutex   // serializes adding and removing bodies of the body store
 
 	// Prevent concurrent downloads of the same cache key
 	downloadMu sync.Mutex
-	inflight   map[string]*sync.WaitGroup
+	inflight   map[string]*download
+
+	activity activityLog // recent requests shown on the dashboard
 
 	transport http.RoundTripper
 }
@@ -41,93 +99,196 @@ func NewDiskCache(config Config, transport http.RoundTripper) (*DiskCache, error
 		return nil, err
 	}
 	c := &DiskCache{
-		config:    config,
-		inflight:  make(map[string]*sync.WaitGroup),
-		transport: transport,
+		inflight: make(map[string]*download),
+		tmpDir:   filepath.Join(config.CacheDir, tmpDirName),
 	}
+	c.conf.Store(&config)
+	c.transport = &registryTransport{next: transport, cache: c}
 
-	// Initialize current size
-	_ = filepath.Walk(c.config.CacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			panic(err)
-		}
-		if err == nil && !info.IsDir() {
-			// clean up temporary files
-			if strings.HasSuffix(info.Name(), ".tmp") {
-				os.Remove(path)
-			} else {
-				c.currSize.Add(info.Size())
-			}
+	// clean up temporary files of unfinished downloads that can not be resumed
+	if err := os.MkdirAll(c.tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := c.cleanTmpDir(); err != nil {
+		return nil, err
+	}
 
-		}
-		return nil
-	})
+	// Initialize index and current size
+	index, err := openIndex(config.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	c.index = index
+	if err := c.cleanBodies(); err != nil {
+		return nil, err
+	}
+	c.currSize.Store(index.totalSize())
 
 	return c, nil
 }
 
+// config returns the current configuration of the cache.
+func (c *DiskCache) config() *Config {
+	return c.conf.Load()
+}
+
+// SetConfig replaces the configuration of the cache, e.g. after a reload. Entries and in-flight downloads are kept,
+// the cache directory can not be changed.
+func (c *DiskCache) SetConfig(config Config) {
+	config.CacheDir = c.config().CacheDir
+	c.conf.Store(&config)
+}
+
+// Close closes the index of the cache.
+func (c *DiskCache) Close() error {
+	return c.index.Close()
+}
+
 // cachePath returns the full filesystem path for a request, grouping by hostname and using the first 4 chars of hash
-// as an extra subdirectory, hash as file name.
+// as an extra subdirectory, hash as file name. The entry is stored in the file cachePath+metaSuffix, its body
+// in the body store.
 func (c *DiskCache) cachePath(req *http.Request) string {
-	// generate non-cryptographic hash of the request method and URL
+	namespace, key := c.cacheKey(req)
+
+	// generate non-cryptographic hash of the key
 	h := fnv.New128a()
-	h.Write([]byte(req.Method))
-	h.Write([]byte(req.URL.String()))
-	key := hex.EncodeToString(h.Sum(nil))
-
-	// build the path: hostname/key[:4]/key
-	hostname := req.URL.Hostname()
-	subdir := key[:4]
-	return filepath.Join(c.config.CacheDir, hostname, subdir, key)
+	h.Write([]byte(key))
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	// build the path: namespace/hash[:4]/hash
+	subdir := hash[:4]
+	return filepath.Join(c.config().CacheDir, namespace, subdir, hash)
 }
 
-// Get returns a cached http.Response if present, else nil. Honors cacheEntryTTL if set.
-func (c *DiskCache) Get(req *http.Request) (*http.Response, os.FileInfo, error) {
+// cacheKey returns the directory and the key of the cache entry for req, by default the hostname
+// and the request method and URL normalized by the key rules.
+func (c *DiskCache) cacheKey(req *http.Request) (string, string) {
+	if namespace, key, ok := c.registryKey(req); ok {
+		return namespace, key
+	}
+	if namespace, key, ok := c.aptKey(req); ok {
+		return namespace, key
+	}
+	u := c.keyURL(req.URL)
+	return u.Hostname(), req.Method + u.String()
+}
+
+// entryPath returns the path of the entry for req. If the cached response varies on request headers,
+// the path of the variant matching the request is returned.
+func (c *DiskCache) entryPath(req *http.Request) string {
+	path := c.cachePath(req)
+	return variantPath(path, readVary(path), req)
+}
+
+// setVary stores the request headers the response for req varies on and removes an entry that was stored
+// for the URL without variants.
+func (c *DiskCache) setVary(req *http.Request, vary []string) error {
 	path := c.cachePath(req)
+	if len(vary) > 0 {
+		c.bodyMu.Lock()
+		c.subSize(c.removeEntry(path))
+		c.bodyMu.Unlock()
+	}
+	return writeVary(path, vary)
+}
+
+// errBrokenEntry is returned by readEntry if the metadata of an entry is invalid, e.g. truncated or edited.
+var errBrokenEntry = errors.New("broken cache entry")
 
-	info, err := os.Stat(path)
+// readEntry reads the metadata of the entry at path and returns it with its size.
+func readEntry(path string) (*cacheEntry, int64, error) {
+	data, err := os.ReadFile(path + metaSuffix)
 	if err != nil {
-		return nil, info, nil // cache miss
+		return nil, 0, err
 	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errBrokenEntry, err)
+	}
+	if entry.Body != "" && !validBodyHash(entry.Body) {
+		return nil, 0, fmt.Errorf("%w: invalid body hash %q", errBrokenEntry, entry.Body)
+	}
+	return &entry, int64(len(data)), nil
+}
 
-	// Touch the file's atime to update LRU (best-effort), but do NOT update mtime!
-	now := time.Now()
-	_ = os.Chtimes(path, now, info.ModTime())
+// Get returns a cached http.Response and its entry if present, else nil.
+func (c *DiskCache) Get(req *http.Request) (*http.Response, *cacheEntry, error) {
+	path := c.entryPath(req)
 
-	f, err := os.Open(path)
+	entry, metaSize, err := readEntry(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil // cache miss
+	}
+	if errors.Is(err, errBrokenEntry) {
+		log.Error("cache entry %s removed: %v", path, err)
+		c.bodyMu.Lock()
+		c.subSize(c.removeEntry(path))
+		c.bodyMu.Unlock()
+		return nil, nil, nil // cache miss
+	}
 	if err != nil {
-		return nil, info, nil // treat as cache miss
+		return nil, nil, err
 	}
-	resp, err := http.ReadResponse(bufio.NewReader(f), req)
+
+	bodyPath := c.bodyPath(path, entry)
+	info, err := os.Stat(bodyPath)
 	if err != nil {
-		f.Close()
-		return nil, info, err
+		return nil, nil, nil // cache miss
+	}
+	entry.size = info.Size()
+	entry.path = path
+	if entry.Stored.IsZero() {
+		entry.Stored = info.ModTime()
 	}
 
-	resp.Body = &bodyWithFile{body: resp.Body, file: f}
-	return resp, info, nil
+	// Update last access in the index for LRU, add the entry if it is missing in the index
+	now := time.Now()
+	if !c.index.touch(path, now) {
+		e := c.newIndexEntry(entry, metaSize)
+		e.Access = now
+		c.bodyMu.Lock()
+		c.index.set(path, e)
+		c.bodyMu.Unlock()
+	}
+
+	f, err := os.Open(bodyPath)
+	if err != nil {
+		return nil, nil, nil // treat as cache miss
+	}
+	return entry.response(req, f, entry.size), entry, nil
 }
 
-// Set stores the HTTP response in the cache. Only stores status, headers, and body.
-// No size or cacheEntryTTL check is performed here; size/ttl checks are handled in the transport and Get.
-func (c *DiskCache) Set(req *http.Request, resp *http.Response) error {
-	path := c.cachePath(req)
+// tmpPath returns the path of a temporary file for the entry at path with the given suffix.
+func (c *DiskCache) tmpPath(path string, suffix string) string {
+	return filepath.Join(c.tmpDir, filepath.Base(path)+suffix+tmpSuffix)
+}
 
-	tmpPath := path + ".tmp"
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+// commit stores the entry and moves the completely written body from tmpPath to the body store, unless a body
+// with the same SHA-256 is already stored. Until then the entry is not visible to Get.
+func (c *DiskCache) commit(path string, entry *cacheEntry, tmpPath string, bodySize int64, hash string) error {
+	entry.Stored = time.Now()
+	entry.Body = hash
+	c.setExpires(entry)
+	data, err := json.Marshal(entry)
+	if err != nil {
 		return err
 	}
-
-	// Write response directly to temp file, count bytes written
-	size, err := writeResponseToTmpFile(tmpPath, resp)
-	if err != nil {
+	metaTmpPath := c.tmpPath(path, metaSuffix)
+	if err := os.WriteFile(metaTmpPath, data, 0644); err != nil {
 		return err
 	}
+	metaSize := int64(len(data))
+
+	c.bodyMu.Lock()
+	defer c.bodyMu.Unlock()
 
 	// Ensure quota: evict LRU files until enough space
-	if c.config.MaxSize > 0 {
-		for c.currSize.Load()+size > int64(c.config.MaxSize) {
+	if c.config().MaxSize > 0 {
+		size := metaSize
+		if !c.index.hasBody(hash) {
+			size += bodySize
+		}
+		for c.currSize.Load()+size > int64(c.config().MaxSize) {
 			evicted, freed, err := c.evictOne()
 			if err != nil {
 				// can't evict, either error or nothing to evict
@@ -141,27 +302,106 @@ func (c *DiskCache) Set(req *http.Request, resp *http.Response) error {
 		}
 	}
 
-	// Rename file to final location
-	if err := os.Rename(tmpPath, path); err != nil {
+	// Remove a previous version of the entry, metadata first so Get never sees a mismatched body
+	c.subSize(c.removeEntry(path))
+
+	// Move the body to the body store, the same content is only stored once
+	bodyPath := bodyStorePath(c.config().CacheDir, hash)
+	size := metaSize
+	_, statErr := os.Stat(bodyPath)
+	shared := c.index.hasBody(hash) && statErr == nil
+	if shared {
 		os.Remove(tmpPath)
+		if c.config().EnableLogging {
+			log.Printf("cache DEDUP: %s %s", entry.URL, humanize.Bytes(uint64(bodySize)))
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(bodyPath), 0755); err != nil {
+			os.Remove(metaTmpPath)
+			return err
+		}
+		if err := os.Rename(tmpPath, bodyPath); err != nil {
+			os.Remove(metaTmpPath)
+			return err
+		}
+		size += bodySize
+	}
+	if err := os.Rename(metaTmpPath, path+metaSuffix); err != nil {
+		os.Remove(metaTmpPath)
+		if !shared {
+			os.Remove(bodyPath)
+		}
 		return err
 	}
 
-	// Update current size
+	// Update index and current size
+	c.index.set(path, indexEntry{
+		Key:      entry.URL,
+		Size:     metaSize,
+		Body:     hash,
+		BodySize: bodySize,
+		Access:   entry.Stored,
+		Expires:  entry.Expires,
+	})
 	c.addSize(size)
 	return nil
 }
 
+// newIndexEntry returns the index entry for the entry with the given metadata size.
+func (c *DiskCache) newIndexEntry(entry *cacheEntry, metaSize int64) indexEntry {
+	e := indexEntry{
+		Key:     entry.URL,
+		Size:    metaSize,
+		Access:  entry.Stored,
+		Expires: entry.Expires,
+	}
+	if entry.Body == "" {
+		e.Size += entry.size
+	} else {
+		e.Body = entry.Body
+		e.BodySize = entry.size
+	}
+	return e
+}
+
+// removeEntry removes the entry at path from the index and the disk and returns the freed bytes.
+// Its body is only removed from the body store if no other entry references it. c.bodyMu must be held.
+func (c *DiskCache) removeEntry(path string) int64 {
+	freed := removeEntryFiles(path)
+	if e, orphan := c.index.remove(path); orphan {
+		if os.Remove(bodyStorePath(c.config().CacheDir, e.Body)) == nil {
+			freed += e.BodySize
+		}
+	}
+	return freed
+}
+
+// removeEntryFiles removes the metadata file and a body file stored next to it of the entry at path
+// and returns the freed bytes.
+func removeEntryFiles(path string) int64 {
+	var freed int64
+	for _, p := range []string{path + metaSuffix, path + bodySuffix} {
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if os.Remove(p) == nil {
+			freed += info.Size()
+		}
+	}
+	return freed
+}
+
 // addSize increases the current size of the cache by sz bytes, ensuring it does not exceed cacheMaxSize.
 func (c *DiskCache) addSize(sz int64) {
-	if c.config.MaxSize > 0 {
+	if c.config().MaxSize > 0 {
 		c.currSize.Add(sz)
 	}
 }
 
 // subSize reduces the current size of the cache by sz bytes, ensuring it does not go below zero.
 func (c *DiskCache) subSize(sz int64) {
-	if c.config.MaxSize > 0 {
+	if c.config().MaxSize > 0 {
 		c.currSize.Add(-sz)
 		if c.currSize.Load() < 0 {
 			c.currSize.Store(0)
@@ -169,187 +409,475 @@ func (c *DiskCache) subSize(sz int64) {
 	}
 }
 
-// evictOne removes the least-recently-used (oldest atime) cache file.
-// Returns true, size of evicted file, and error.
-// This implementation uses Linux-specific syscall.Stat_t for robust access time retrieval.
+// evictOne removes the least-recently-used cache entry according to the index.
+// Returns true, size of evicted files, and error. c.bodyMu must be held.
 func (c *DiskCache) evictOne() (bool, int64, error) {
-	var oldestPath string
-	var oldestInfo os.FileInfo
-	var oldestAtime time.Time
-
-	err := filepath.Walk(c.config.CacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-
-		stat, ok := info.Sys().(*syscall.Stat_t)
-		if !ok {
-			return nil
-		}
-
-		// Use Atim for access time (Linux-specific)
-		atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
-		if oldestInfo == nil || atime.Before(oldestAtime) {
-			oldestInfo = info
-			oldestPath = path
-			oldestAtime = atime
-		}
-		return nil
-	})
-
-	if err != nil {
-		return false, 0, err
-	}
-
-	if oldestInfo == nil {
+	oldestPath := c.index.oldest()
+	if oldestPath == "" {
 		return false, 0, nil
 	}
 
-	size := oldestInfo.Size()
-	if err := os.Remove(oldestPath); err != nil {
-		return false, 0, err
-	}
+	size := c.removeEntry(oldestPath)
 
-	if c.config.EnableLogging {
+	if c.config().EnableLogging {
 		log.Printf("cache DELETE: %s", oldestPath)
 	}
 	return true, size, nil
 }
 
-// doSingleflightDownload performs the download, cache, and returns the response for a cache miss.
-// It handles inflight map cleanup and wg.Done().
+// releaseDownload removes the download from the inflight map and wakes up clients waiting for it.
+func (c *DiskCache) releaseDownload(inflightKey string, dl *download) {
+	c.downloadMu.Lock()
+	delete(c.inflight, inflightKey)
+	dl.wg.Done()
+	c.downloadMu.Unlock()
+}
+
+// doSingleflightDownload performs the download and returns the response for a cache miss.
+// Cacheable responses are streamed to the client while they are written to the cache by fill,
+// which also takes care of the inflight map cleanup. In all other cases this is done here.
 // If the response is too large to cache (by ContentLength), it is returned directly and not stored.
-func (c *DiskCache) doSingleflightDownload(req *http.Request, inflightKey string, wg *sync.WaitGroup) (*http.Response, error) {
+func (c *DiskCache) doSingleflightDownload(req *http.Request, inflightKey string, dl *download) (*http.Response, error) {
+	streaming := false
 	defer func() {
-		c.downloadMu.Lock()
-		delete(c.inflight, inflightKey)
-		wg.Done()
-		c.downloadMu.Unlock()
+		if !streaming {
+			dl.finish(nil)
+			c.releaseDownload(inflightKey, dl)
+		}
 	}()
 
+	// continue an interrupted download of the entry if possible
+	path := c.entryPath(req)
+	upstreamReq := req
+	partial := c.loadPartial(path)
+	if partial != nil {
+		upstreamReq = resumeRequest(req, resumeValidator(partial.Entry.Header), partial.size)
+	}
+
 	// Download the response body
-	origResp, err := c.transport.RoundTrip(req)
+	origResp, err := c.transport.RoundTrip(upstreamReq)
 	// return on error
 	if err != nil || origResp == nil {
 		return origResp, err
 	}
 
-	// only handle StatusOK and StatusNotModified
-	if origResp.StatusCode != http.StatusNotModified && origResp.StatusCode != http.StatusOK {
+	if partial != nil {
+		if resumeMatches(origResp, partial.size, partial.Length) {
+			resp, err := c.resumeDownload(req, path, partial, origResp, inflightKey, dl)
+			streaming = err == nil
+			return resp, err
+		}
+
+		// the stored part is outdated, start over
+		if c.config().EnableLogging {
+			log.Printf("cache RESUME-FAILED: %s %s: %s", req.Method, req.URL.String(), origResp.Status)
+		}
+		c.removePartial(path)
+		if origResp.StatusCode != http.StatusOK {
+			origResp.Body.Close()
+			origResp, err = c.transport.RoundTrip(req)
+			if err != nil || origResp == nil {
+				return origResp, err
+			}
+		}
+	}
+
+	// only handle cacheable status codes and StatusNotModified
+	if origResp.StatusCode != http.StatusNotModified && !c.cacheableStatus(origResp.StatusCode, origResp.Header) {
 		return origResp, err
 	}
 
+	// apply the policy rule matching the response
+	policy := c.policy(req.URL, origResp.Header.Get("Content-Type"))
+	if policy.bypass && origResp.StatusCode != http.StatusNotModified {
+		if c.config().EnableLogging {
+			log.Printf("cache BYPASS: %s %s", req.Method, req.URL.String())
+		}
+		return origResp, nil
+	}
+
 	// handle cache control headers (but only if not StatusNotModified)
-	if !c.config.IgnoreServerCacheControl && origResp.StatusCode != http.StatusNotModified {
-		reasons, _, err := cacheobject.UsingRequestResponse(req, origResp.StatusCode, origResp.Header, false)
+	if !policy.ignoreServerCacheControl && origResp.StatusCode != http.StatusNotModified {
+		statusCode := origResp.StatusCode
+		if statusCode == http.StatusPermanentRedirect {
+			statusCode = http.StatusMovedPermanently // cacheable by default since RFC 9110, unknown to cacheobject
+		}
+		reasons, _, err := cacheobject.UsingRequestResponse(req, statusCode, origResp.Header, false)
 		if err != nil {
-			if c.config.EnableLogging {
+			if c.config().EnableLogging {
 				log.Printf("cache control error: %s %s: %v", req.Method, req.URL.String(), err)
 			}
 			return origResp, err
 		}
+		if ref, ok := c.registryRef(req.URL); ok && ref.kind != registryManifestTag {
+			// content addressed registry content is identified by digest, not by the credentials used to pull it.
+			// Manifests by tag of private repositories must not be served to other clients.
+			reasons = slices.DeleteFunc(reasons, func(reason cacheobject.Reason) bool {
+				return reason == cacheobject.ReasonRequestAuthorizationHeader
+			})
+		}
 		if len(reasons) > 0 {
-			if c.config.EnableLogging {
+			if c.config().EnableLogging {
 				log.Printf("cache control ignore: %s %s: %v", req.Method, req.URL.String(), reasons)
 			}
 			return origResp, nil // do not cache this response
 		}
 	}
 
-	// if response indicates not modified, update modification time
+	// if response indicates not modified, update the stored headers and freshness
 	if origResp.StatusCode == http.StatusNotModified {
-		now := time.Now()
-		_ = os.Chtimes(c.cachePath(req), now, now)
+		if err := c.refreshEntry(path, origResp.Header); err != nil {
+			if os.IsNotExist(err) {
+				// conditional request of the client without a cached entry
+				return origResp, nil
+			}
+			origResp.Body.Close()
+			return nil, fmt.Errorf("failed to update cache entry: %w", err)
+		}
 
-		response, info, err := c.Get(req)
+		response, entry, err := c.Get(req)
 		if err != nil {
+			origResp.Body.Close()
 			return nil, fmt.Errorf("failed to get cache entry: %w", err)
 		}
-		if c.config.EnableLogging {
-			log.Printf("cache MISS-UP: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(info.Size())))
+		if response == nil {
+			// entry vanished in the meantime
+			return origResp, nil
+		}
+		origResp.Body.Close()
+		if c.config().EnableLogging {
+			log.Printf("cache MISS-UP: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(entry.size)))
 		}
 		return response, nil
-	} else {
-		// Only check the limit if ContentLength is given (>= 0).
-		if c.config.EntryMaxSize > 0 && origResp.ContentLength > int64(c.config.EntryMaxSize) && origResp.ContentLength >= 0 {
-			if c.config.EnableLogging {
-				log.Printf("response TOO LARGE to cache: %s %s (Content-Length: %d, Limit: %d)",
-					req.Method, req.URL.String(), origResp.ContentLength, c.config.EntryMaxSize)
-			}
-			return origResp, nil
+	}
+
+	// Only check the limit if ContentLength is given (>= 0).
+	if policy.maxSize > 0 && origResp.ContentLength > policy.maxSize && origResp.ContentLength >= 0 {
+		if c.config().EnableLogging {
+			log.Printf("response TOO LARGE to cache: %s %s (Content-Length: %d, Limit: %d)",
+				req.Method, req.URL.String(), origResp.ContentLength, policy.maxSize)
+		}
+		return origResp, nil
+	}
+
+	// responses varying on everything can never be served from cache
+	vary, varyAll := varyHeaders(origResp.Header)
+	if varyAll {
+		if c.config().EnableLogging {
+			log.Printf("cache vary ignore: %s %s", req.Method, req.URL.String())
 		}
+		return origResp, nil
+	}
 
-		// update cache with the response
-		err = c.Set(req, origResp)
+	// stream the response into the cache while it is passed to the client
+	path = variantPath(c.cachePath(req), vary, req)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		origResp.Body.Close()
-		if err != nil {
-			return nil, fmt.Errorf("cache set error: %w", err)
+		return nil, fmt.Errorf("cache set error: %w", err)
+	}
+	if err := c.setVary(req, vary); err != nil {
+		origResp.Body.Close()
+		return nil, fmt.Errorf("cache set error: %w", err)
+	}
+	f, err := os.Create(c.tmpPath(path, bodySuffix))
+	if err != nil {
+		origResp.Body.Close()
+		return nil, fmt.Errorf("cache set error: %w", err)
+	}
+
+	entry := &cacheEntry{URL: req.URL.String(), StatusCode: origResp.StatusCode, Header: origResp.Header.Clone()}
+	resp, err := c.streamResponse(req, path, entry, origResp, f, 0, origResp.ContentLength, inflightKey, dl)
+	streaming = err == nil
+	return resp, err
+}
+
+// resumeDownload continues the interrupted download of the entry at path with the partial response resp and
+// returns the complete response for the client.
+func (c *DiskCache) resumeDownload(req *http.Request, path string, partial *partialDownload, resp *http.Response, inflightKey string, dl *download) (*http.Response, error) {
+	c.removePartial(path)
+	f, err := os.OpenFile(c.tmpPath(path, bodySuffix), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cache resume error: %w", err)
+	}
+
+	if c.config().EnableLogging {
+		log.Printf("cache RESUME: %s %s at %s", req.Method, req.URL.String(), humanize.Bytes(uint64(partial.size)))
+	}
+	return c.streamResponse(req, path, &partial.Entry, resp, f, partial.size, partial.Length, inflightKey, dl)
+}
+
+// streamResponse starts writing the body of resp to the temporary file f, which already contains offset bytes,
+// and returns the response for the client, reading the body while it is written.
+func (c *DiskCache) streamResponse(req *http.Request, path string, entry *cacheEntry, resp *http.Response, f *os.File, offset int64, length int64, inflightKey string, dl *download) (*http.Response, error) {
+	tmpPath := c.tmpPath(path, bodySuffix)
+	dl.start(entry, path, tmpPath, length, offset)
+	dl.mu.Lock()
+	body, err := dl.newReader()
+	dl.mu.Unlock()
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		resp.Body.Close()
+		return nil, fmt.Errorf("cache set error: %w", err)
+	}
+
+	go c.fill(req, path, entry, resp, f, inflightKey, dl)
+	return entry.response(req, body, length), nil
+}
+
+// fill copies the upstream response body into the temporary file of the download and commits the entry once
+// the body is complete. Clients following the download read the data as it arrives.
+// If the upstream connection breaks, the download is resumed up to Config.ResumeRetries times.
+// Downloads that still fail are kept to be resumed by a later request.
+func (c *DiskCache) fill(req *http.Request, path string, entry *cacheEntry, resp *http.Response, f *os.File, inflightKey string, dl *download) {
+	defer c.releaseDownload(inflightKey, dl)
+
+	// the body is hashed while it is written, resumed downloads are hashed once they are complete
+	hash := sha256.New()
+	resumed := dl.size() > 0
+
+	w := &downloadWriter{dl: dl, file: f, hash: hash}
+	validator := resumeValidator(entry.Header)
+	_, copyErr := io.Copy(w, resp.Body)
+	resp.Body.Close()
+	for attempt := 1; copyErr != nil && validator != "" && attempt <= c.config().ResumeRetries; attempt++ {
+		offset := dl.size()
+		if c.config().EnableLogging {
+			log.Printf("cache RESUME: %s %s at %s (attempt %d): %v", req.Method, req.URL.String(),
+				humanize.Bytes(uint64(offset)), attempt, copyErr)
 		}
+		time.Sleep(time.Duration(attempt) * time.Second)
 
-		response, info, err := c.Get(req)
+		resp, err := c.resume(req, validator, offset, dl.length)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get cache entry: %w", err)
+			copyErr = err
+			continue
+		}
+		_, copyErr = io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}
+
+	size := dl.size()
+	err := copyErr
+	if err == nil {
+		// Ensure data is flushed to disk before renaming
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil && resumed {
+		hash.Reset()
+		err = hashFile(hash, dl.tmpPath, size)
+	}
+	if err == nil {
+		// content addressed entries are shared by all hosts, they must match their digest
+		err = c.verifyDigest(req.URL, hex.EncodeToString(hash.Sum(nil)))
+	}
+	dl.finish(err)
+
+	if err == nil {
+		err = c.commit(path, entry, dl.tmpPath, size, hex.EncodeToString(hash.Sum(nil)))
+	}
+	if err != nil {
+		// keep interrupted downloads to continue them later
+		if copyErr != nil && validator != "" && size > 0 && c.savePartial(path, entry, dl.length) == nil {
+			if c.config().EnableLogging {
+				log.Printf("cache PARTIAL: %s %s %s: %v", req.Method, req.URL.String(), humanize.Bytes(uint64(size)), err)
+			}
+			return
 		}
-		if c.config.EnableLogging {
-			log.Printf("cache MISS: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(info.Size())))
+
+		os.Remove(dl.tmpPath)
+		if c.config().EnableLogging {
+			log.Printf("cache set error: %s %s: %v", req.Method, req.URL.String(), err)
 		}
-		return response, nil
+		return
+	}
+
+	if c.config().EnableLogging {
+		log.Printf("cache MISS: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(size)))
 	}
 }
 
 // RoundTrip implements http.RoundTripper. Only GET requests are cached.
-// If multiple requests for the same URL come in concurrently, only one will download the file.
+// If multiple requests for the same URL come in concurrently, only one will download the file,
+// the others read the body while it is written to the cache.
+// Range requests are served from the complete cached response, which is downloaded on a cache miss.
 func (c *DiskCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.isRegistryPassthrough(req) {
+		return c.transport.RoundTrip(req) // registry authentication and API calls
+	}
+	if c.policy(req.URL, "").bypass {
+		return c.transport.RoundTrip(req) // excluded by a policy rule
+	}
+	if req.Method == http.MethodHead {
+		return c.head(req)
+	}
 	if req.Method != http.MethodGet {
 		return c.transport.RoundTrip(req) // bypass cache
 	}
-	inflightKey := req.URL.String()
 
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" {
+		resp, isHit, err := c.roundTrip(req)
+		if err == nil && resp != nil {
+			resp.Body = &countingReadCloser{rc: resp.Body, isHit: isHit}
+		}
+		return resp, err
+	}
+
+	// fetch the complete response, so it gets cached and later range requests are hits
+	fullReq := req.Clone(req.Context())
+	fullReq.Header.Del("Range")
+	fullReq.Header.Del("If-Range")
+	resp, isHit, err := c.roundTrip(fullReq)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+
+	if rangeResp := applyRange(resp, rangeHeader, req.Header.Get("If-Range")); rangeResp != nil {
+		rangeResp.Body = &countingReadCloser{rc: rangeResp.Body, isHit: isHit}
+		return rangeResp, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body = &countingReadCloser{rc: resp.Body, isHit: isHit}
+		return resp, nil
+	}
+
+	// the response is not stored in the cache or its size is unknown, request the range from upstream
+	resp.Body.Close()
+	if c.config().EnableLogging {
+		log.Printf("cache RANGE-BYPASS: %s %s %s", req.Method, req.URL.String(), rangeHeader)
+	}
+	resp, err = c.transport.RoundTrip(req)
+	if err == nil && resp != nil {
+		resp.Body = &countingReadCloser{rc: resp.Body, isHit: false}
+	}
+	return resp, err
+}
+
+// roundTrip returns the cached response for req or downloads it on a cache miss.
+// The second return value is true if the response was served from the cache.
+func (c *DiskCache) roundTrip(req *http.Request) (*http.Response, bool, error) {
+	dirs := c.requestDirectives(req)
 	for {
-		resp, info, err := c.Get(req)
+		// downloads are tracked per entry path, so different variants of a URL are downloaded independently
+		inflightKey := c.entryPath(req)
+
+		resp, entry, err := c.Get(req)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
+		var staleWindow time.Duration
+		missResult := "MISS"
 		if resp != nil {
-			// cacheEntryTTL check: if configured and file is too old, treat as miss
-			// also set etag of old request to If-None-Match header
-			if c.config.EntryTTL > 0 && time.Since(info.ModTime()) > c.config.EntryTTL {
-				if c.config.EnableLogging {
-					log.Info("cache EXPIRED: %s (expired %v ago, cacheEntryTTL %v)", req.URL.String(), time.Since(info.ModTime()), c.config.EntryTTL)
+			// freshness check: if the entry is stale or not accepted by the client, treat as miss
+			// also set validators of old request as conditional headers
+			expired := entry.expired()
+			if expired && c.config().OfflineMode {
+				// in offline mode everything in the cache is served regardless of its age
+				if c.config().EnableLogging {
+					log.Printf("cache HIT-OFFLINE: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(entry.size)))
 				}
-				// pass etag to request if available
-				if resp.Header.Get("ETag") != "" {
-					req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+				markStale(resp, entry, warningDisconnected)
+				c.countHit(req, resp, entry, "STALE")
+				mCacheRequestsStaleTotal.Inc()
+				return resp, true, nil
+			}
+			if dirs.allows(entry) {
+				result := "HIT"
+				if expired {
+					// the client accepts stale responses (max-stale)
+					markStale(resp, entry, warningStale)
+					mCacheRequestsStaleTotal.Inc()
+					result = "STALE"
+				}
+				if c.config().EnableLogging {
+					log.Printf("cache HIT: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(entry.size)))
 				}
+				c.countHit(req, resp, entry, result)
+				return resp, true, nil
+			}
+			if dirs.onlyIfCached {
+				resp.Body.Close()
+				return c.gatewayTimeout(req), false, nil
+			}
 
-			} else {
-				if c.config.EnableLogging {
-					log.Printf("cache HIT: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(info.Size())))
+			// serve the expired entry while it is revalidated in the background (stale-while-revalidate)
+			if window := c.staleWhileRevalidate(resp.Header); expired && !dirs.restricted() && window > 0 && entry.staleFor() <= window {
+				if c.config().EnableLogging {
+					log.Printf("cache HIT-STALE: %s %s %s", req.Method, req.URL.String(), humanize.Bytes(uint64(entry.size)))
 				}
-				mCacheRequestsTotal.Inc()
-				mCacheRequestsHitTotal.Inc()
-				resp.Body = &countingReadCloser{rc: resp.Body, isHit: true}
-				return resp, nil
+				c.revalidate(req, inflightKey, resp.Header)
+				markStale(resp, entry, warningStale)
+				c.countHit(req, resp, entry, "STALE")
+				mCacheRequestsStaleTotal.Inc()
+				return resp, true, nil
+			}
+
+			missResult = "REVALIDATE"
+			if expired {
+				staleWindow = c.staleIfError(req, resp.Header)
+				missResult = "EXPIRED"
 			}
+			if c.config().EnableLogging {
+				if expired {
+					log.Info("cache EXPIRED: %s (expired %v ago)", req.URL.String(), entry.staleFor())
+				} else {
+					log.Info("cache REVALIDATE: %s (requested by client)", req.URL.String())
+				}
+			}
+			// pass validators of the cached response to the request
+			addValidators(req, resp.Header)
+			resp.Body.Close()
+		} else if dirs.onlyIfCached {
+			return c.gatewayTimeout(req), false, nil
 		}
 
 		c.downloadMu.Lock()
-		if wg, ok := c.inflight[inflightKey]; ok {
+		if dl, ok := c.inflight[inflightKey]; ok {
 			c.downloadMu.Unlock()
-			wg.Wait()
+
+			// read the body while it is downloaded by another request
+			if entry, length, body := dl.follow(); entry != nil {
+				// the request may select a different variant than the one downloaded
+				vary, _ := varyHeaders(entry.Header)
+				if variantPath(c.cachePath(req), vary, req) != dl.path {
+					body.Close()
+					dl.wg.Wait()
+					continue
+				}
+
+				if c.config().EnableLogging {
+					log.Printf("cache HIT-STREAM: %s %s", req.Method, req.URL.String())
+				}
+				resp := entry.response(req, body, length)
+				c.countHit(req, resp, nil, "HIT")
+				return resp, true, nil
+			}
+			dl.wg.Wait()
 			continue
 		}
-		wg := &sync.WaitGroup{}
-		wg.Add(1)
-		c.inflight[inflightKey] = wg
+		dl := newDownload()
+		c.inflight[inflightKey] = dl
 		c.downloadMu.Unlock()
 
-		resp, err = c.doSingleflightDownload(req, inflightKey, wg)
+		resp, err = c.doSingleflightDownload(req, inflightKey, dl)
+
+		// serve the expired entry if upstream is not usable (stale-if-error)
+		if reason := upstreamFailure(resp, err); staleWindow > 0 && reason != "" {
+			if staleResp, entry := c.getStale(req, staleWindow, reason); staleResp != nil {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				c.countHit(req, staleResp, entry, "STALE")
+				return staleResp, true, nil
+			}
+		}
+
 		if err == nil && resp != nil {
-			mCacheRequestsTotal.Inc()
-			mCacheRequestsMissTotal.Inc()
-			resp.Body = &countingReadCloser{rc: resp.Body, isHit: false}
+			c.countMiss(req, resp, missResult)
 		}
-		return resp, err
+		return resp, false, err
 	}
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// leafRenewal is the fraction of the validity after which host certificates are renewed.
+const leafRenewal = 0.9
+
+// certStore persists host certificates with their keys as PEM files, so they survive restarts.
+type certStore struct {
+	dir string
+}
+
+// newCertStore creates the directory of the store.
+func newCertStore(dir string) (*certStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &certStore{dir: dir}, nil
+}
+
+// path returns the file of the certificate for host.
+func (s *certStore) path(host string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(host))
+	return filepath.Join(s.dir, name+".pem")
+}
+
+// load reads the certificate for host. It only contains the host certificate, without the CA chain.
+func (s *certStore) load(host string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(s.path(host))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// save writes the host certificate and key of cert for host.
+func (s *certStore) save(host string, cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("empty certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	// replace the file atomically, so a crash never leaves a partially written certificate
+	path := s.path(host)
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// usable checks if cert is a certificate for host issued by the CA, which is not due for renewal.
+func (a *certAuthority) usable(host string, cert *tls.Certificate) bool {
+	leaf := cert.Leaf
+	if leaf == nil || leaf.CheckSignatureFrom(a.cert) != nil || leaf.VerifyHostname(host) != nil {
+		return false
+	}
+	renewAt := leaf.NotBefore.Add(time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * leafRenewal))
+	return time.Now().Before(renewAt)
+}
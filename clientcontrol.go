@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/gomitmproxy/proxyutil"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// requestDirectives holds the Cache-Control directives of a client request that restrict which cached
+// responses may be used to answer it (RFC 9111 section 5.2.1).
+type requestDirectives struct {
+	noCache      bool          // cached responses must be revalidated
+	maxAge       time.Duration // maximum accepted age, -1 if not set
+	maxStale     time.Duration // maximum accepted time since expiry, -1 if not set
+	minFresh     time.Duration // minimum remaining freshness, -1 if not set
+	onlyIfCached bool          // upstream must not be contacted
+}
+
+// requestDirectives returns the cache directives of req. If IgnoreClientCacheControl is set, or the header can
+// not be parsed, no directives are returned.
+func (c *DiskCache) requestDirectives(req *http.Request) requestDirectives {
+	dirs := requestDirectives{maxAge: -1, maxStale: -1, minFresh: -1}
+	if c.config().IgnoreClientCacheControl {
+		return dirs
+	}
+
+	value := req.Header.Get("Cache-Control")
+	if value == "" {
+		// Pragma is only considered for HTTP/1.0 clients that do not send Cache-Control
+		for _, pragma := range strings.Split(req.Header.Get("Pragma"), ",") {
+			if strings.EqualFold(strings.TrimSpace(pragma), "no-cache") {
+				dirs.noCache = true
+			}
+		}
+		return dirs
+	}
+
+	reqDir, err := cacheobject.ParseRequestCacheControl(value)
+	if err != nil {
+		return dirs
+	}
+	dirs.noCache = reqDir.NoCache
+	dirs.onlyIfCached = reqDir.OnlyIfCached
+	if reqDir.MaxAge >= 0 {
+		dirs.maxAge = time.Duration(reqDir.MaxAge) * time.Second
+	}
+	if reqDir.MinFresh >= 0 {
+		dirs.minFresh = time.Duration(reqDir.MinFresh) * time.Second
+	}
+	if reqDir.MaxStale >= 0 {
+		dirs.maxStale = time.Duration(reqDir.MaxStale) * time.Second
+	} else if reqDir.MaxStaleSet {
+		// max-stale without a value accepts responses of any staleness
+		dirs.maxStale = math.MaxInt64
+	}
+	return dirs
+}
+
+// restricted returns true if the request limits the age of the responses it accepts, so the entry must not be
+// served stale while it is revalidated.
+func (d requestDirectives) restricted() bool {
+	return d.noCache || d.maxAge >= 0 || d.minFresh >= 0
+}
+
+// allows checks if the entry may be served without contacting upstream. Expired entries are only allowed
+// within max-stale, unless the response requires revalidation.
+func (d requestDirectives) allows(entry *cacheEntry) bool {
+	if d.noCache {
+		return false
+	}
+	if d.maxAge >= 0 && entry.age() > d.maxAge {
+		return false
+	}
+	if d.minFresh >= 0 && !entry.Expires.IsZero() && time.Until(entry.Expires) < d.minFresh {
+		return false
+	}
+	if !entry.expired() {
+		return true
+	}
+	if d.maxStale < 0 || entry.staleFor() > d.maxStale {
+		return false
+	}
+	respDir, err := cacheobject.ParseResponseCacheControl(entry.Header.Get("Cache-Control"))
+	return err == nil && !respDir.NoCachePresent && !respDir.MustRevalidate && !respDir.ProxyRevalidate
+}
+
+// gatewayTimeout returns the response to an only-if-cached request that can not be answered from the cache.
+func (c *DiskCache) gatewayTimeout(req *http.Request) *http.Response {
+	if c.config().EnableLogging {
+		log.Printf("cache MISS-ONLY-IF-CACHED: %s %s", req.Method, req.URL.String())
+	}
+	resp := proxyutil.NewResponse(http.StatusGatewayTimeout, nil, req)
+	c.countMiss(req, resp, "MISS")
+	return resp
+}
@@ -42,21 +42,75 @@ func (b *ByteSize) UnmarshalText(data []byte) error {
 // Config holds the configuration for the cache system.
 type Config struct {
 	ListenAddr               string        `env:"LISTEN_ADDR" envDefault:":8090"`
+	AdminAddr                string        `env:"ADMIN_ADDR"`                                     // listen address of the admin API, empty disables it
 	CacheDir                 string        `env:"CACHE_DIR" envDefault:"cache"`                   // directory where cache files are stored
 	MaxSize                  ByteSize      `env:"MAX_SIZE" envDefault:"10GB"`                     // maximum size (in bytes) used for cache storage, 0 means unlimited
 	EntryMaxSize             ByteSize      `env:"ENTRY_MAX_SIZE" envDefault:"500MB"`              // maximum size (in bytes) for a single cached response, 0 means unlimited
-	EntryTTL                 time.Duration `env:"ENTRY_TTL" envDefault:"1h"`                      // time-to-live for each cache entry, 0 means no expiration
+	EntryTTL                 time.Duration `env:"ENTRY_TTL" envDefault:"1h"`                      // time-to-live for entries without freshness information from the server, also caps heuristic freshness, 0 means no expiration
+	HeuristicFactor          float64       `env:"HEURISTIC_FACTOR" envDefault:"0.1"`              // fraction of the time since Last-Modified used as heuristic freshness lifetime, 0 disables heuristic freshness
 	EnableLogging            bool          `env:"ENABLE_LOGGING" envDefault:"true"`               // whether to enable logging of cache operations
 	IgnoreServerCacheControl bool          `env:"IGNORE_SERVER_CACHE_CONTROL" envDefault:"false"` // whether to ignore cache control headers from the server
+	ResumeRetries            int           `env:"RESUME_RETRIES" envDefault:"3"`                  // number of attempts to resume an interrupted upstream download, 0 disables retries
+	StaleIfError             time.Duration `env:"STALE_IF_ERROR" envDefault:"0"`                  // how long expired entries are served if upstream fails, unless set by the stale-if-error directive
+	StaleWhileRevalidate     time.Duration `env:"STALE_WHILE_REVALIDATE" envDefault:"0"`          // how long expired entries are served while revalidated in the background, unless set by the stale-while-revalidate directive
+	OfflineMode              bool          `env:"OFFLINE_MODE" envDefault:"false"`                // whether to serve all cached entries regardless of age and only go upstream on cache misses
+	IgnoreClientCacheControl bool          `env:"IGNORE_CLIENT_CACHE_CONTROL" envDefault:"false"` // whether to ignore cache control headers from clients
+	HeadFill                 bool          `env:"HEAD_FILL" envDefault:"false"`                   // whether a HEAD request for an uncached URL fetches the GET response into the cache in the background
+	PermanentRedirectTTL     time.Duration `env:"PERMANENT_REDIRECT_TTL" envDefault:"24h"`        // time-to-live for permanent redirects (301, 308) without freshness information, 0 disables caching them
+	CacheTemporaryRedirects  bool          `env:"CACHE_TEMPORARY_REDIRECTS" envDefault:"true"`    // whether temporary redirects (302, 303, 307) with freshness information from the server are cached
+	NegativeTTL              time.Duration `env:"NEGATIVE_TTL" envDefault:"1m"`                   // maximum time-to-live for 404 and 410 responses, 0 disables caching them
+	RegistryMode             bool          `env:"REGISTRY_MODE" envDefault:"false"`               // whether Docker/OCI registry requests are cached by digest and tag
+	RegistryTagTTL           time.Duration `env:"REGISTRY_TAG_TTL" envDefault:"5m"`               // time-to-live for registry manifests requested by tag, 0 means no expiration
+	AptMode                  bool          `env:"APT_MODE" envDefault:"false"`                    // whether Debian/Ubuntu repositories are cached with fixed lifetimes for packages and indexes
+	AptIndexTTL              time.Duration `env:"APT_INDEX_TTL" envDefault:"1m"`                  // time-to-live for apt repository indexes, 0 means no expiration
+	KeyRules                 KeyRules      `env:"KEY_RULES"`                                      // rules normalizing the cache key per host as JSON list
+	PolicyRules              PolicyRules   `env:"POLICY_RULES"`                                   // ordered rules overriding the caching configuration per host, path and content type as JSON list
+	UpstreamCAFiles          []string      `env:"UPSTREAM_CA_FILES"`                              // PEM bundles of CAs trusted for upstream servers in addition to the system pool
+	InsecureHosts            []string      `env:"INSECURE_HOSTS"`                                 // upstream hosts (wildcards allowed) whose certificates are not verified
+	MitmHosts                []string      `env:"MITM_HOSTS"`                                     // hosts (wildcards allowed) whose TLS connections are intercepted, empty means all hosts
+	PassthroughHosts         []string      `env:"PASSTHROUGH_HOSTS"`                              // hosts (wildcards allowed) whose TLS connections are tunneled without interception
+	CACert                   string        `env:"CA_CERT" envDefault:"ca.crt"`                    // PEM file of the CA certificate signing intercepted hosts, created with CA_KEY if both are missing
+	CAKey                    string        `env:"CA_KEY" envDefault:"ca.key"`                     // PEM file of the CA private key
+	CAKeyType                string        `env:"CA_KEY_TYPE" envDefault:"rsa2048"`               // key type of a created CA and of host certificates: rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519
+	CertDir                  string        `env:"CERT_DIR" envDefault:"certs"`                    // directory where generated host certificates are stored, empty keeps them in memory only
+
+	// apt mirror hosts (wildcards allowed) mapped to groups sharing one cache namespace
+	AptMirrors map[string]string `env:"APT_MIRRORS" envDefault:"*.debian.org:debian,archive.ubuntu.com:ubuntu,*.archive.ubuntu.com:ubuntu,security.ubuntu.com:ubuntu"`
 }
 
 func (c *Config) Print() {
 	log.Info("Config:")
 	log.Info("  ListenAddr: %s", c.ListenAddr)
+	log.Info("  AdminAddr: %s", c.AdminAddr)
 	log.Info("  CacheDir: %s", c.CacheDir)
 	log.Info("  MaxSize: %s", humanize.IBytes(uint64(c.MaxSize)))
 	log.Info("  EntryMaxSize: %s", humanize.IBytes(uint64(c.EntryMaxSize)))
 	log.Info("  EntryTTL: %s", c.EntryTTL)
+	log.Info("  HeuristicFactor: %g", c.HeuristicFactor)
 	log.Info("  EnableLogging: %t", c.EnableLogging)
 	log.Info("  IgnoreServerCacheControl: %t", c.IgnoreServerCacheControl)
+	log.Info("  ResumeRetries: %d", c.ResumeRetries)
+	log.Info("  StaleIfError: %s", c.StaleIfError)
+	log.Info("  StaleWhileRevalidate: %s", c.StaleWhileRevalidate)
+	log.Info("  OfflineMode: %t", c.OfflineMode)
+	log.Info("  IgnoreClientCacheControl: %t", c.IgnoreClientCacheControl)
+	log.Info("  HeadFill: %t", c.HeadFill)
+	log.Info("  PermanentRedirectTTL: %s", c.PermanentRedirectTTL)
+	log.Info("  CacheTemporaryRedirects: %t", c.CacheTemporaryRedirects)
+	log.Info("  NegativeTTL: %s", c.NegativeTTL)
+	log.Info("  RegistryMode: %t", c.RegistryMode)
+	log.Info("  RegistryTagTTL: %s", c.RegistryTagTTL)
+	log.Info("  AptMode: %t", c.AptMode)
+	log.Info("  AptIndexTTL: %s", c.AptIndexTTL)
+	log.Info("  AptMirrors: %v", c.AptMirrors)
+	log.Info("  KeyRules: %s", c.KeyRules)
+	log.Info("  PolicyRules: %s", c.PolicyRules)
+	log.Info("  UpstreamCAFiles: %v", c.UpstreamCAFiles)
+	log.Info("  InsecureHosts: %v", c.InsecureHosts)
+	log.Info("  MitmHosts: %v", c.MitmHosts)
+	log.Info("  PassthroughHosts: %v", c.PassthroughHosts)
+	log.Info("  CACert: %s", c.CACert)
+	log.Info("  CAKey: %s", c.CAKey)
+	log.Info("  CAKeyType: %s", c.CAKeyType)
+	log.Info("  CertDir: %s", c.CertDir)
 }
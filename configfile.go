@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v11"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configFileEnv is the environment variable holding the path of the optional configuration file.
+	configFileEnv = "CONFIG_FILE"
+
+	// configPollInterval is the interval the configuration file is checked for changes.
+	configPollInterval = 5 * time.Second
+)
+
+// loadConfig reads the configuration from the environment variables and the optional configuration file at path.
+// Environment variables take precedence over the file, which takes precedence over the defaults.
+func loadConfig(path string) (Config, error) {
+	environment := map[string]string{}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", path, err)
+		}
+		environment = values
+	}
+	for key, value := range env.ToMap(os.Environ()) {
+		environment[key] = value
+	}
+
+	config, err := env.ParseAsWithOptions[Config](env.Options{Environment: environment})
+	if err != nil {
+		return Config{}, err
+	}
+	return config, config.validate()
+}
+
+// readConfigFile reads the YAML or TOML configuration file at path and returns its values as environment
+// variables. Keys are the lowercase names of the environment variables, e.g. "cache_dir" for CACHE_DIR.
+// Rules may be written as lists and maps like AptMirrors as maps.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, errors.New("unsupported file type, expected .yaml, .yml or .toml")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]reflect.Type{}
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Config{})) {
+		if name := field.Tag.Get("env"); name != "" {
+			fields[name] = field.Type
+		}
+	}
+
+	environment := make(map[string]string, len(values))
+	for key, value := range values {
+		name := strings.ToUpper(key)
+		fieldType, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		text, err := configValue(value, fieldType)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		environment[name] = text
+	}
+	return environment, nil
+}
+
+// textUnmarshalerType is the type of fields decoded by UnmarshalText, like the rules.
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// configValue converts a value of the configuration file to the format of the environment variable of a
+// field with the given type.
+func configValue(value any, fieldType reflect.Type) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case map[string]any:
+		if fieldType.Kind() == reflect.Map {
+			// format of env maps: key1:value1,key2:value2
+			pairs := make([]string, 0, len(v))
+			for key, value := range v {
+				pairs = append(pairs, fmt.Sprintf("%s:%v", key, value))
+			}
+			slices.Sort(pairs)
+			return strings.Join(pairs, ","), nil
+		}
+	case []any:
+		if fieldType.Kind() == reflect.Slice && !reflect.PointerTo(fieldType).Implements(textUnmarshalerType) {
+			// format of env lists: value1,value2
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			return strings.Join(items, ","), nil
+		}
+	case []map[string]any:
+	default:
+		return fmt.Sprint(v), nil
+	}
+
+	// rules are decoded from JSON
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// validate checks the configuration for invalid values.
+func (c *Config) validate() error {
+	switch {
+	case c.ListenAddr == "":
+		return errors.New("LISTEN_ADDR must not be empty")
+	case c.CacheDir == "":
+		return errors.New("CACHE_DIR must not be empty")
+	case c.MaxSize < 0:
+		return errors.New("MAX_SIZE must not be negative")
+	case c.EntryMaxSize < 0:
+		return errors.New("ENTRY_MAX_SIZE must not be negative")
+	case c.EntryTTL < 0:
+		return errors.New("ENTRY_TTL must not be negative")
+	case c.HeuristicFactor < 0:
+		return errors.New("HEURISTIC_FACTOR must not be negative")
+	case c.ResumeRetries < 0:
+		return errors.New("RESUME_RETRIES must not be negative")
+	case c.CACert == "" || c.CAKey == "":
+		return errors.New("CA_CERT and CA_KEY must not be empty")
+	case !slices.Contains(keyTypes, c.CAKeyType):
+		return fmt.Errorf("CA_KEY_TYPE must be one of %s", strings.Join(keyTypes, ", "))
+	}
+	return nil
+}
+
+// reloadConfig reads the configuration again and applies it to the cache. Settings that require a restart
+// are kept. An invalid configuration is logged and ignored.
+func reloadConfig(path string, current Config, cache *DiskCache) Config {
+	config, err := loadConfig(path)
+	if err != nil {
+		log.Error("config reload failed: %s", err)
+		return current
+	}
+	if config.ListenAddr != current.ListenAddr {
+		log.Info("config reload: changing ListenAddr requires a restart")
+		config.ListenAddr = current.ListenAddr
+	}
+	if config.AdminAddr != current.AdminAddr {
+		log.Info("config reload: changing AdminAddr requires a restart")
+		config.AdminAddr = current.AdminAddr
+	}
+	if !slices.Equal(config.UpstreamCAFiles, current.UpstreamCAFiles) || !slices.Equal(config.InsecureHosts, current.InsecureHosts) {
+		log.Info("config reload: changing UpstreamCAFiles or InsecureHosts requires a restart")
+		config.UpstreamCAFiles = current.UpstreamCAFiles
+		config.InsecureHosts = current.InsecureHosts
+	}
+	if config.CACert != current.CACert || config.CAKey != current.CAKey || config.CAKeyType != current.CAKeyType ||
+		config.CertDir != current.CertDir {
+		log.Info("config reload: changing CACert, CAKey, CAKeyType or CertDir requires a restart")
+		config.CACert, config.CAKey, config.CAKeyType = current.CACert, current.CAKey, current.CAKeyType
+		config.CertDir = current.CertDir
+	}
+	if config.CacheDir != current.CacheDir {
+		log.Info("config reload: changing CacheDir requires a restart")
+		config.CacheDir = current.CacheDir
+	}
+
+	cache.SetConfig(config)
+	log.Info("config reloaded")
+	config.Print()
+	return config
+}
+
+// watchConfigFile sends to changed whenever the modification time or size of the file at path changes.
+func watchConfigFile(path string, changed chan<- struct{}) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	for range time.Tick(configPollInterval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // e.g. replaced by an editor
+		}
+		if !info.ModTime().Equal(lastMod) || info.Size() != lastSize {
+			lastMod, lastSize = info.ModTime(), info.Size()
+			changed <- struct{}{}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigLists(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+insecure_hosts: [a.example, "*.internal"]
+mitm_hosts:
+  - x.example
+passthrough_hosts: []
+key_rules:
+  - host: "*.s3.amazonaws.com"
+    strip_query: ["X-Amz-*"]
+`,
+		"config.toml": `
+insecure_hosts = ["a.example", "*.internal"]
+mitm_hosts = ["x.example"]
+passthrough_hosts = []
+key_rules = [{ host = "*.s3.amazonaws.com", strip_query = ["X-Amz-*"] }]
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := loadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := []string{"a.example", "*.internal"}; !slices.Equal(config.InsecureHosts, want) {
+				t.Errorf("InsecureHosts = %q, want %q", config.InsecureHosts, want)
+			}
+			if want := []string{"x.example"}; !slices.Equal(config.MitmHosts, want) {
+				t.Errorf("MitmHosts = %q, want %q", config.MitmHosts, want)
+			}
+			if len(config.PassthroughHosts) != 0 {
+				t.Errorf("PassthroughHosts = %q, want none", config.PassthroughHosts)
+			}
+			if !config.interceptHost("x.example") || config.interceptHost("y.example") {
+				t.Error("MitmHosts not applied")
+			}
+			if len(config.KeyRules) != 1 || config.KeyRules[0].Host != "*.s3.amazonaws.com" ||
+				!slices.Equal(config.KeyRules[0].StripQuery, []string{"X-Amz-*"}) {
+				t.Errorf("KeyRules = %+v", config.KeyRules)
+			}
+		})
+	}
+}
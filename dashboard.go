@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	_ "embed"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dashboardTopHosts is the number of hosts listed on the dashboard.
+const dashboardTopHosts = 10
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboardHost describes the cached entries and requests of a host on the dashboard.
+type dashboardHost struct {
+	Host     string `json:"host"`
+	Entries  int    `json:"entries"`
+	Size     int64  `json:"size"`
+	Requests int64  `json:"requests"`
+	Hits     int64  `json:"hits"`
+}
+
+// dashboardDownload describes a running download on the dashboard.
+type dashboardDownload struct {
+	URL     string    `json:"url"` // empty until the response headers are received
+	Path    string    `json:"path"`
+	Written int64     `json:"written"`
+	Length  int64     `json:"length"` // -1 if unknown
+	Started time.Time `json:"started"`
+}
+
+// dashboardData is the response of the dashboard endpoint of the admin API.
+type dashboardData struct {
+	adminStats
+	Requests        int64               `json:"requests"`    // requests handled by the cache since the start
+	Hits            int64               `json:"hits"`        // requests answered from the cache
+	Stale           int64               `json:"stale"`       // requests answered with stale entries
+	HitRatio        float64             `json:"hit_ratio"`   // fraction of requests answered from the cache
+	Bytes           int64               `json:"bytes"`       // bytes sent to clients
+	BytesSaved      int64               `json:"bytes_saved"` // bytes sent to clients from the cache instead of upstream
+	HostsBySize     []dashboardHost     `json:"hosts_by_size"`
+	HostsByRequests []dashboardHost     `json:"hosts_by_requests"`
+	Recent          []requestRecord     `json:"recent"`
+	Downloads       []dashboardDownload `json:"downloads"`
+}
+
+// metricValue returns the current value of a counter or gauge.
+func metricValue(m prometheus.Metric) int64 {
+	var metric dto.Metric
+	if m.Write(&metric) != nil {
+		return 0
+	}
+	if metric.Counter != nil {
+		return int64(metric.Counter.GetValue())
+	}
+	return int64(metric.Gauge.GetValue())
+}
+
+// handleDashboard serves the web dashboard, which polls the dashboard endpoint.
+func (c *DiskCache) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// handleDashboardData reports the metrics, top hosts, recent requests and running downloads for the dashboard.
+func (c *DiskCache) handleDashboardData(w http.ResponseWriter, r *http.Request) {
+	entries, saved := c.index.stats()
+	data := dashboardData{
+		adminStats: adminStats{
+			Size:       c.size(),
+			MaxSize:    int64(c.config().MaxSize),
+			Entries:    entries,
+			DedupSaved: saved,
+		},
+		Requests:   metricValue(mCacheRequestsTotal),
+		Hits:       metricValue(mCacheRequestsHitTotal),
+		Stale:      metricValue(mCacheRequestsStaleTotal),
+		Bytes:      metricValue(mCacheRequestsBytes),
+		BytesSaved: metricValue(mCacheRequestsHitBytes),
+	}
+	if data.Requests > 0 {
+		data.HitRatio = float64(data.Hits) / float64(data.Requests)
+	}
+
+	// merge the cached entries and the requests per host
+	recent, requests := c.activity.snapshot()
+	data.Recent = recent
+	hosts := make(map[string]*dashboardHost)
+	for name, size := range c.index.hostSizes() {
+		hosts[name] = &dashboardHost{Host: name, Entries: size.Entries, Size: size.Size}
+	}
+	for name, activity := range requests {
+		h, ok := hosts[name]
+		if !ok {
+			h = &dashboardHost{Host: name}
+			hosts[name] = h
+		}
+		h.Requests, h.Hits = activity.Requests, activity.Hits
+	}
+	list := make([]dashboardHost, 0, len(hosts))
+	for _, h := range hosts {
+		list = append(list, *h)
+	}
+	data.HostsBySize = topHosts(list, func(h dashboardHost) int64 { return h.Size })
+	data.HostsByRequests = topHosts(list, func(h dashboardHost) int64 { return h.Requests })
+
+	c.downloadMu.Lock()
+	inflight := maps.Clone(c.inflight)
+	c.downloadMu.Unlock()
+	for key, dl := range inflight {
+		url, written, length := dl.progress()
+		data.Downloads = append(data.Downloads, dashboardDownload{
+			URL:     url,
+			Path:    c.index.rel(key),
+			Written: written,
+			Length:  length,
+			Started: dl.started,
+		})
+	}
+	data.Inflight = len(data.Downloads)
+	slices.SortFunc(data.Downloads, func(a, b dashboardDownload) int {
+		return a.Started.Compare(b.Started)
+	})
+
+	writeJSON(w, data)
+}
+
+// topHosts returns the dashboardTopHosts hosts with the highest non-zero value.
+func topHosts(hosts []dashboardHost, value func(h dashboardHost) int64) []dashboardHost {
+	hosts = slices.DeleteFunc(slices.Clone(hosts), func(h dashboardHost) bool { return value(h) == 0 })
+	slices.SortFunc(hosts, func(a, b dashboardHost) int {
+		if n := cmp.Compare(value(b), value(a)); n != 0 {
+			return n
+		}
+		return strings.Compare(a.Host, b.Host)
+	})
+	return hosts[:min(dashboardTopHosts, len(hosts))]
+}
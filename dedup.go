@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// bodiesDirName is the directory of the content addressed body store inside the cache directory.
+// Bodies are stored once under their SHA-256, no matter how many entries reference them.
+const bodiesDirName = ".bodies"
+
+// validBodyHash checks if hash is a hex encoded SHA-256 as used to name bodies in the body store.
+func validBodyHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// bodyStorePath returns the path of the body with the given SHA-256 in the body store of the cache directory dir.
+func bodyStorePath(dir string, hash string) string {
+	return filepath.Join(dir, bodiesDirName, hash[:2], hash)
+}
+
+// bodyPath returns the path of the body of the entry at path. Entries stored before the body store was
+// introduced keep their body next to the metadata.
+func (c *DiskCache) bodyPath(path string, entry *cacheEntry) string {
+	if entry.Body == "" {
+		return path + bodySuffix
+	}
+	return bodyStorePath(c.config().CacheDir, entry.Body)
+}
+
+// hashFile writes the first n bytes of the file at path to h.
+func hashFile(h hash.Hash, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+// cleanBodies removes bodies that are not referenced by any entry, e.g. after an unclean shutdown.
+func (c *DiskCache) cleanBodies() error {
+	dir := filepath.Join(c.config().CacheDir, bodiesDirName)
+	var removed int
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && !c.index.hasBody(info.Name()) {
+			if os.Remove(path) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+
+	if c.config().EnableLogging && removed > 0 {
+		log.Info("removed %d unreferenced bodies", removed)
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// download tracks a cache miss that is currently fetched from upstream.
+// If the response is stored in the cache, the body is written to a temporary file and
+// clients can read it through a downloadReader while the download is still running.
+type download struct {
+	wg      sync.WaitGroup // done once the download finished and the entry is committed
+	started time.Time      // time the download was started
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	entry   *cacheEntry // metadata of the streamed response, nil if nothing is streamed
+	path    string      // path of the entry the response is stored at
+	length  int64       // content length announced by upstream, -1 if unknown
+	tmpPath string      // temporary body file the response is streamed into
+	written int64       // bytes written to tmpPath so far
+	done    bool        // true if no more bytes will be written
+	err     error       // error that aborted the download
+}
+
+// newDownload creates a new download that is marked as in progress.
+func newDownload() *download {
+	d := &download{started: time.Now()}
+	d.cond = sync.NewCond(&d.mu)
+	d.wg.Add(1)
+	return d
+}
+
+// start marks the download as streaming into tmpPath, which already contains written bytes,
+// and wakes up waiting clients.
+func (d *download) start(entry *cacheEntry, path string, tmpPath string, length int64, written int64) {
+	d.mu.Lock()
+	d.entry = entry
+	d.path = path
+	d.tmpPath = tmpPath
+	d.length = length
+	d.written = written
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// finish marks the download as done, no more bytes are written afterward.
+func (d *download) finish(err error) {
+	d.mu.Lock()
+	if !d.done {
+		d.done = true
+		d.err = err
+	}
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// wrote counts bytes written to the temporary file and wakes up readers.
+func (d *download) wrote(n int) {
+	d.mu.Lock()
+	d.written += int64(n)
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// size returns the number of bytes written to the temporary file.
+func (d *download) size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.written
+}
+
+// progress returns the URL of the streamed response, the bytes written so far and the announced length.
+// The URL is empty if the response is not streamed yet.
+func (d *download) progress() (string, int64, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.entry == nil {
+		return "", d.written, -1
+	}
+	return d.entry.URL, d.written, d.length
+}
+
+// follow waits until the download either streams its body or finished.
+// It returns the entry, the announced length and a reader for the body if the download is still streaming,
+// otherwise the entry is nil and the caller should wait for the download and check the cache again.
+func (d *download) follow() (*cacheEntry, int64, io.ReadCloser) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.entry == nil && !d.done {
+		d.cond.Wait()
+	}
+	if d.entry == nil || d.done {
+		return nil, 0, nil
+	}
+
+	reader, err := d.newReader()
+	if err != nil {
+		return nil, 0, nil
+	}
+	return d.entry, d.length, reader
+}
+
+// newReader opens a new reader for the streamed body. d.mu must be held.
+func (d *download) newReader() (*downloadReader, error) {
+	f, err := os.Open(d.tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	return &downloadReader{dl: d, file: f}, nil
+}
+
+// downloadWriter writes the response body to the temporary file and notifies the download about progress.
+type downloadWriter struct {
+	dl   *download
+	file *os.File
+	hash hash.Hash // SHA-256 of the body written so far
+}
+
+// Write writes data to the temporary file. It implements the io.Writer interface.
+func (w *downloadWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	if n > 0 {
+		w.hash.Write(p[:n])
+		w.dl.wrote(n)
+	}
+	return n, err
+}
+
+// downloadReader reads the body of a download while it is still written to disk.
+// Reads block until more data is available or the download finished.
+type downloadReader struct {
+	dl     *download
+	file   *os.File
+	offset int64
+}
+
+// Read reads already downloaded data from the temporary file. It implements the io.Reader interface.
+func (r *downloadReader) Read(p []byte) (int, error) {
+	r.dl.mu.Lock()
+	for r.offset >= r.dl.written && !r.dl.done {
+		r.dl.cond.Wait()
+	}
+	available := r.dl.written - r.offset
+	err := r.dl.err
+	r.dl.mu.Unlock()
+
+	if available <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads data at the given offset, waiting until it is downloaded. It implements the io.ReaderAt interface.
+func (r *downloadReader) ReadAt(p []byte, off int64) (int, error) {
+	r.dl.mu.Lock()
+	for r.dl.written < off+int64(len(p)) && !r.dl.done {
+		r.dl.cond.Wait()
+	}
+	written := r.dl.written
+	err := r.dl.err
+	r.dl.mu.Unlock()
+
+	if err == nil {
+		err = io.EOF
+	}
+	if off >= written {
+		return 0, err
+	}
+	if int64(len(p)) > written-off {
+		p = p[:written-off]
+		n, rerr := r.file.ReadAt(p, off)
+		if rerr == nil {
+			rerr = err
+		}
+		return n, rerr
+	}
+	return r.file.ReadAt(p, off)
+}
+
+// Close closes the temporary file. It implements the io.Closer interface.
+func (r *downloadReader) Close() error {
+	return r.file.Close()
+}
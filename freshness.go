@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// explicitLifetime returns the freshness lifetime the server assigned to a response with the given headers
+// received at the given time (RFC 9111 section 4.2.1). The second return value is false if the response contains
+// no explicit expiration information.
+func explicitLifetime(header http.Header, received time.Time) (time.Duration, bool) {
+	respDir, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	if err == nil {
+		switch {
+		case respDir.NoCachePresent:
+			return 0, true // must be revalidated on every request
+		case respDir.SMaxAge >= 0: // this is a shared cache
+			return time.Duration(respDir.SMaxAge) * time.Second, true
+		case respDir.MaxAge >= 0:
+			return time.Duration(respDir.MaxAge) * time.Second, true
+		}
+	}
+
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0, true // invalid values like "0" represent a time in the past
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = received
+		}
+		return max(expires.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// heuristicLifetime returns a freshness lifetime for a response without explicit expiration information
+// (RFC 9111 section 4.2.2) as a fraction of the time since it was last modified, capped by maxLifetime.
+// The second return value is false if no heuristic can be applied.
+func (c *DiskCache) heuristicLifetime(header http.Header, received time.Time, maxLifetime time.Duration) (time.Duration, bool) {
+	if c.config().HeuristicFactor <= 0 {
+		return 0, false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return 0, false
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = received
+	}
+	if !lastModified.Before(date) {
+		return 0, false
+	}
+
+	lifetime := time.Duration(float64(date.Sub(lastModified)) * c.config().HeuristicFactor)
+	if maxLifetime > 0 {
+		lifetime = min(lifetime, maxLifetime)
+	}
+	return lifetime, true
+}
+
+// initialAge returns the age of a response with the given headers at the time it was received
+// (RFC 9111 section 4.2.3), based on the Age header and the difference to the Date header.
+func initialAge(header http.Header, received time.Time) time.Duration {
+	var age time.Duration
+	if seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		age = max(age, received.Sub(date))
+	}
+	return age
+}
+
+// setExpires computes the time the entry expires from its headers and the time it was stored.
+// Without freshness information from the server, EntryTTL is used as fallback, which also caps heuristic lifetimes.
+// Permanent redirects fall back to PermanentRedirectTTL and 404/410 responses never live longer than NegativeTTL.
+// Registry content and apt repository files have fixed lifetimes. Policy rules may override EntryTTL and
+// IgnoreServerCacheControl.
+func (c *DiskCache) setExpires(entry *cacheEntry) {
+	if c.registryExpires(entry) || c.aptExpires(entry) {
+		return
+	}
+
+	policy := cachePolicy{ttl: c.config().EntryTTL, ignoreServerCacheControl: c.config().IgnoreServerCacheControl}
+	if u, err := url.Parse(entry.URL); err == nil {
+		policy = c.policy(u, entry.Header.Get("Content-Type"))
+	}
+	ttl := policy.ttl
+	switch {
+	case isPermanentRedirect(entry.StatusCode):
+		ttl = c.config().PermanentRedirectTTL
+	case isNegative(entry.StatusCode):
+		ttl = c.config().NegativeTTL
+	}
+
+	if !policy.ignoreServerCacheControl {
+		lifetime, ok := explicitLifetime(entry.Header, entry.Stored)
+		if !ok {
+			lifetime, ok = c.heuristicLifetime(entry.Header, entry.Stored, policy.ttl)
+		}
+		if ok {
+			entry.Expires = entry.Stored.Add(lifetime - initialAge(entry.Header, entry.Stored))
+			if isNegative(entry.StatusCode) && entry.Expires.After(entry.Stored.Add(ttl)) {
+				entry.Expires = entry.Stored.Add(ttl)
+			}
+			return
+		}
+	}
+
+	entry.Expires = time.Time{}
+	if ttl > 0 {
+		entry.Expires = entry.Stored.Add(ttl)
+	}
+}
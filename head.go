@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// getRequest returns the GET request whose cache entry is used to answer the HEAD request req.
+func getRequest(req *http.Request) *http.Request {
+	getReq := req.Clone(req.Context())
+	getReq.Method = http.MethodGet
+	getReq.Header.Del("Range")
+	getReq.Header.Del("If-Range")
+	getReq.Header.Del("If-None-Match")
+	getReq.Header.Del("If-Modified-Since")
+	return getReq
+}
+
+// head answers a HEAD request with the status and headers of the cached GET response for the same URL
+// without reading its body. On a cache miss the request is sent upstream and, if HeadFill is enabled,
+// the GET response is fetched into the cache in the background.
+func (c *DiskCache) head(req *http.Request) (*http.Response, error) {
+	dirs := c.requestDirectives(req)
+	getReq := getRequest(req)
+
+	resp, entry, err := c.Get(getReq)
+	if err != nil {
+		return nil, err
+	}
+	var storedHeader http.Header
+	if resp != nil {
+		storedHeader = entry.Header
+		resp.Body.Close()
+		resp.Body = http.NoBody
+		resp.Request = req
+
+		expired := entry.expired()
+		if (expired && c.config().OfflineMode) || dirs.allows(entry) {
+			result := "HIT"
+			if expired && c.config().OfflineMode {
+				markStale(resp, entry, warningDisconnected)
+				mCacheRequestsStaleTotal.Inc()
+				result = "STALE"
+			} else if expired {
+				markStale(resp, entry, warningStale)
+				mCacheRequestsStaleTotal.Inc()
+				result = "STALE"
+			}
+			if c.config().EnableLogging {
+				log.Printf("cache HIT: %s %s", req.Method, req.URL.String())
+			}
+			c.countHit(req, resp, nil, result)
+			return resp, nil
+		}
+	}
+
+	// the headers of a download in progress are already known
+	c.downloadMu.Lock()
+	dl, ok := c.inflight[c.entryPath(getReq)]
+	c.downloadMu.Unlock()
+	if ok {
+		if entry, length, body := dl.follow(); entry != nil {
+			body.Close()
+			if c.config().EnableLogging {
+				log.Printf("cache HIT-STREAM: %s %s", req.Method, req.URL.String())
+			}
+			resp := entry.response(req, http.NoBody, length)
+			c.countHit(req, resp, nil, "HIT")
+			return resp, nil
+		}
+	}
+
+	if dirs.onlyIfCached {
+		return c.gatewayTimeout(req), nil
+	}
+
+	resp, err = c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if c.config().EnableLogging {
+		log.Printf("cache MISS: %s %s", req.Method, req.URL.String())
+	}
+	c.countMiss(req, resp, "MISS")
+
+	if c.config().HeadFill && resp.StatusCode == http.StatusOK {
+		// an expired entry is revalidated instead of downloaded again
+		c.revalidate(getReq, c.entryPath(getReq), storedHeader)
+	}
+	return resp, nil
+}
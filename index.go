@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	indexFileName = ".index" // journal file of the cache index inside the cache directory
+	tmpDirName    = ".tmp"   // directory for files that are still written inside the cache directory
+
+	// indexCompactMin is the minimum number of journal records before the journal is compacted.
+	indexCompactMin = 10000
+)
+
+// indexEntry describes a single cache entry in the index.
+type indexEntry struct {
+	Key      string    `json:"key"`                 // URL of the cached response
+	Path     string    `json:"path"`                // path of the entry relative to the cache directory, without suffix
+	Size     int64     `json:"size"`                // size of all files of the entry, except a body in the body store
+	Body     string    `json:"body,omitempty"`      // SHA-256 of the body in the body store, empty if stored next to the metadata
+	BodySize int64     `json:"body_size,omitempty"` // size of the body in the body store
+	Access   time.Time `json:"access"`              // time of the last access
+	Expires  time.Time `json:"expires,omitzero"`    // time the entry expires, zero if it never expires
+	Hits     int64     `json:"hits,omitempty"`      // number of requests answered with the entry
+
+	heapIndex int // position in cacheIndex.lru
+}
+
+// hostSize is the number and size of the entries of a host.
+type hostSize struct {
+	Entries int
+	Size    int64
+}
+
+// indexRecord is a single line of the index journal.
+type indexRecord struct {
+	Op string `json:"op"` // "set", "touch", "hit" or "delete"
+	indexEntry
+}
+
+// indexBody is a body in the body store that is referenced by one or more entries.
+type indexBody struct {
+	size int64
+	refs int
+}
+
+// lruHeap orders index entries by last access, the least recently used entry first.
+type lruHeap []*indexEntry
+
+func (h lruHeap) Len() int           { return len(h) }
+func (h lruHeap) Less(i, j int) bool { return h[i].Access.Before(h[j].Access) }
+func (h lruHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+func (h *lruHeap) Push(x any) {
+	e := x.(*indexEntry)
+	e.heapIndex = len(*h)
+	*h = append(*h, e)
+}
+func (h *lruHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.heapIndex = -1
+	return e
+}
+
+// cacheIndex keeps track of all cache entries, so eviction and size accounting do not need to walk the cache
+// directory. Every change is appended to a journal file that is loaded on startup and compacted once it contains
+// too many outdated records. If the journal is missing or corrupt, the index is rebuilt from the cache directory.
+type cacheIndex struct {
+	dir string // cache directory
+
+	mu      sync.Mutex
+	journal *os.File
+	records int // number of records in the journal
+	entries map[string]*indexEntry
+	bodies  map[string]*indexBody // bodies in the body store by SHA-256
+	lru     lruHeap
+	size    int64 // total size of all entries and bodies
+	saved   int64 // size of bodies not stored again because they are referenced by multiple entries
+}
+
+// openIndex loads the index of the cache directory dir or rebuilds it from the files on disk.
+func openIndex(dir string) (*cacheIndex, error) {
+	ix := &cacheIndex{
+		dir:     dir,
+		entries: make(map[string]*indexEntry),
+		bodies:  make(map[string]*indexBody),
+	}
+
+	err := ix.load()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Info("cache index corrupt, rebuilding: %v", err)
+		} else {
+			log.Info("cache index missing, rebuilding...")
+		}
+		ix.entries = make(map[string]*indexEntry)
+		ix.bodies = make(map[string]*indexBody)
+		ix.lru = nil
+		ix.size = 0
+		ix.saved = 0
+		if err := ix.rebuild(); err != nil {
+			return nil, fmt.Errorf("failed to rebuild cache index: %w", err)
+		}
+	}
+
+	// write a compact journal with the current state to get rid of outdated records
+	if err := ix.compact(); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// load reads the journal file and replays all records.
+func (ix *cacheIndex) load() error {
+	data, err := os.ReadFile(filepath.Join(ix.dir, indexFileName))
+	if err != nil {
+		return err
+	}
+
+	// ignore a torn last record from an unclean shutdown
+	if i := bytes.LastIndexByte(data, '\n'); i < len(data)-1 {
+		data = data[:i+1]
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record indexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if record.Path == "" {
+			return fmt.Errorf("line %d: missing path", line)
+		}
+		if record.Body != "" && !validBodyHash(record.Body) {
+			return fmt.Errorf("line %d: invalid body hash %q", line, record.Body)
+		}
+		switch record.Op {
+		case "set":
+			ix.apply(record.indexEntry)
+		case "touch":
+			if e, ok := ix.entries[record.Path]; ok {
+				e.Access = record.Access
+				heap.Fix(&ix.lru, e.heapIndex)
+			}
+		case "hit":
+			if e, ok := ix.entries[record.Path]; ok {
+				e.Hits++
+			}
+		case "delete":
+			ix.drop(record.Path)
+		default:
+			return fmt.Errorf("line %d: unknown operation %q", line, record.Op)
+		}
+	}
+	return scanner.Err()
+}
+
+// entryFileRegexp matches the file names of entries in the hash prefix directories of the cache, including entries
+// of older versions without suffix and temporary files.
+var entryFileRegexp = regexp.MustCompile(`^[0-9a-f]{32}(-[0-9a-f]{32})?(\.meta|\.body|\.vary)?(\.tmp)?$`)
+
+// isEntryFile checks if path is a file of the cache layout namespace/hash[:4]/hash.
+func isEntryFile(path string) bool {
+	name := filepath.Base(path)
+	return entryFileRegexp.MatchString(name) && filepath.Base(filepath.Dir(path)) == name[:4]
+}
+
+// rebuild walks the cache directory and adds all complete entries to the index. Entry files of unknown format,
+// e.g. entries of older versions or temporary files, are removed, as they would never be evicted. Files not
+// matching the layout of the cache are left alone, the directory may be shared with other data.
+func (ix *cacheIndex) rebuild() error {
+	var removed int
+	defer func() {
+		if removed > 0 {
+			log.Info("removed %d files of unknown format", removed)
+		}
+	}()
+	return filepath.Walk(ix.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != ix.dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isEntryFile(path) {
+			return nil
+		}
+		if !strings.HasSuffix(path, metaSuffix) {
+			switch {
+			case strings.HasSuffix(path, varySuffix):
+			case strings.HasSuffix(path, bodySuffix):
+				// bodies without metadata belong to incomplete entries
+				if _, err := os.Stat(strings.TrimSuffix(path, bodySuffix) + metaSuffix); err != nil && os.Remove(path) == nil {
+					removed++
+				}
+			default:
+				if os.Remove(path) == nil {
+					removed++
+				}
+			}
+			return nil
+		}
+
+		base := strings.TrimSuffix(path, metaSuffix)
+		entry, _, err := readEntry(base)
+		if errors.Is(err, errBrokenEntry) {
+			removeEntryFiles(base)
+			return nil
+		}
+		if err != nil {
+			return nil
+		}
+		bodyPath := base + bodySuffix
+		if entry.Body != "" {
+			bodyPath = bodyStorePath(ix.dir, entry.Body)
+		}
+		bodyInfo, err := os.Stat(bodyPath)
+		if err != nil {
+			// incomplete or broken entry
+			removeEntryFiles(base)
+			return nil
+		}
+
+		access := bodyInfo.ModTime()
+		if stat, ok := bodyInfo.Sys().(*syscall.Stat_t); ok {
+			access = time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+		}
+		e := indexEntry{
+			Key:    entry.URL,
+			Path:   ix.rel(base),
+			Size:   info.Size() + bodyInfo.Size(),
+			Access: access,
+		}
+		if entry.Body != "" {
+			e.Size = info.Size()
+			e.Body = entry.Body
+			e.BodySize = bodyInfo.Size()
+		}
+		ix.apply(e)
+		return nil
+	})
+}
+
+// compact rewrites the journal with one record per entry and reopens it for appending.
+func (ix *cacheIndex) compact() error {
+	path := filepath.Join(ix.dir, indexFileName)
+	tmpPath := path + tmpSuffix
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range ix.lru {
+		if err := enc.Encode(indexRecord{Op: "set", indexEntry: *e}); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if ix.journal != nil {
+		ix.journal.Close()
+	}
+	ix.journal, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	ix.records = len(ix.lru)
+	return err
+}
+
+// append writes a record to the journal and compacts it if it became too large. ix.mu must be held.
+func (ix *cacheIndex) append(record indexRecord) {
+	data, err := json.Marshal(record)
+	if err == nil {
+		_, err = ix.journal.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Error("failed to write cache index: %v", err)
+		return
+	}
+
+	ix.records++
+	if ix.records > indexCompactMin && ix.records > 2*len(ix.entries) {
+		if err := ix.compact(); err != nil {
+			log.Error("failed to compact cache index: %v", err)
+		}
+	}
+}
+
+// apply adds or replaces an entry without writing the journal. It returns the replaced entry, if any, and
+// true if its body in the body store is no longer referenced. ix.mu must be held.
+func (ix *cacheIndex) apply(entry indexEntry) (*indexEntry, bool) {
+	e := &entry
+	// reference the body before the replaced entry is dropped, so a body shared by both is kept
+	if e.Body != "" {
+		b, ok := ix.bodies[e.Body]
+		if !ok {
+			b = &indexBody{size: e.BodySize}
+			ix.bodies[e.Body] = b
+			ix.size += b.size
+		} else {
+			ix.saved += b.size
+		}
+		b.refs++
+	}
+
+	old, orphan := ix.drop(e.Path)
+	if old != nil && e.Hits == 0 {
+		e.Hits = old.Hits // e.g. refreshed after revalidation
+	}
+	ix.entries[e.Path] = e
+	heap.Push(&ix.lru, e)
+	ix.size += e.Size
+	mCacheDedupSavedBytes.Set(float64(ix.saved))
+	return old, orphan
+}
+
+// drop removes an entry without writing the journal. It returns the removed entry, if any, and true if its body
+// in the body store is no longer referenced. ix.mu must be held.
+func (ix *cacheIndex) drop(path string) (*indexEntry, bool) {
+	e, ok := ix.entries[path]
+	if !ok {
+		return nil, false
+	}
+	delete(ix.entries, path)
+	heap.Remove(&ix.lru, e.heapIndex)
+	ix.size -= e.Size
+	if e.Body == "" {
+		return e, false
+	}
+
+	b := ix.bodies[e.Body]
+	b.refs--
+	if b.refs > 0 {
+		ix.saved -= b.size
+		mCacheDedupSavedBytes.Set(float64(ix.saved))
+		return e, false
+	}
+	delete(ix.bodies, e.Body)
+	ix.size -= b.size
+	return e, true
+}
+
+// rel converts a path inside the cache directory to the form stored in the index.
+func (ix *cacheIndex) rel(path string) string {
+	rel, err := filepath.Rel(ix.dir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// abs converts a path stored in the index to a path inside the cache directory.
+func (ix *cacheIndex) abs(path string) string {
+	return filepath.Join(ix.dir, filepath.FromSlash(path))
+}
+
+// set adds or replaces the entry stored at path (without suffix). It returns the replaced entry, if any, and
+// true if its body in the body store is no longer referenced.
+func (ix *cacheIndex) set(path string, entry indexEntry) (*indexEntry, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	entry.Path = ix.rel(path)
+	old, orphan := ix.apply(entry)
+	ix.append(indexRecord{Op: "set", indexEntry: entry})
+	return old, orphan
+}
+
+// touch updates the last access time of the entry at path. Returns false if the entry is not indexed.
+func (ix *cacheIndex) touch(path string, access time.Time) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	e, ok := ix.entries[ix.rel(path)]
+	if !ok {
+		return false
+	}
+	e.Access = access
+	heap.Fix(&ix.lru, e.heapIndex)
+	ix.append(indexRecord{Op: "touch", indexEntry: indexEntry{Path: e.Path, Access: access}})
+	return true
+}
+
+// hit increments the hit count of the entry at path, if it is indexed.
+func (ix *cacheIndex) hit(path string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	e, ok := ix.entries[ix.rel(path)]
+	if !ok {
+		return
+	}
+	e.Hits++
+	ix.append(indexRecord{Op: "hit", indexEntry: indexEntry{Path: e.Path}})
+}
+
+// remove deletes the entry at path from the index. It returns the removed entry, if any, and true if its body
+// in the body store is no longer referenced.
+func (ix *cacheIndex) remove(path string) (*indexEntry, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	e, orphan := ix.drop(ix.rel(path))
+	if e != nil {
+		ix.append(indexRecord{Op: "delete", indexEntry: indexEntry{Path: e.Path}})
+	}
+	return e, orphan
+}
+
+// hasBody checks if an entry references the body with the given SHA-256.
+func (ix *cacheIndex) hasBody(hash string) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	_, ok := ix.bodies[hash]
+	return ok
+}
+
+// find returns copies of all entries for which match returns true.
+func (ix *cacheIndex) find(match func(e *indexEntry) bool) []indexEntry {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	var entries []indexEntry
+	for _, e := range ix.entries {
+		if match(e) {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+// stats returns the number of indexed entries and the size of bodies saved by deduplication.
+func (ix *cacheIndex) stats() (int, int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.entries), ix.saved
+}
+
+// hostSizes returns the number of entries and their size including bodies per host of the entry URLs.
+func (ix *cacheIndex) hostSizes() map[string]hostSize {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	hosts := make(map[string]hostSize)
+	for _, e := range ix.entries {
+		var host string
+		if u, err := url.Parse(e.Key); err == nil {
+			host = u.Hostname()
+		}
+		h := hosts[host]
+		h.Entries++
+		h.Size += e.Size + e.BodySize
+		hosts[host] = h
+	}
+	return hosts
+}
+
+// oldest returns the path (without suffix) of the least recently used entry or an empty string if the index is empty.
+func (ix *cacheIndex) oldest() string {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if len(ix.lru) == 0 {
+		return ""
+	}
+	return ix.abs(ix.lru[0].Path)
+}
+
+// totalSize returns the size of all indexed entries.
+func (ix *cacheIndex) totalSize() int64 {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.size
+}
+
+// Close closes the journal file.
+func (ix *cacheIndex) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.journal.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRebuildKeepsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	entryDir := filepath.Join(dir, "example.com", "0123")
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	foreign := []string{
+		filepath.Join(dir, "ca.key"),
+		filepath.Join(dir, "certs", "example.com.pem"),
+		filepath.Join(dir, "notes.meta"),
+		filepath.Join(entryDir, "README"),
+	}
+	legacy := filepath.Join(entryDir, "0123456789abcdef0123456789abcdef")
+	for _, path := range append(foreign, legacy) {
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewDiskCache(Config{CacheDir: dir}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, path := range foreign {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("foreign file removed by rebuild: %v", err)
+		}
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("entry of unknown format not removed: %v", err)
+	}
+}
+
+func TestBrokenBodyHash(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(Config{CacheDir: dir, EntryTTL: time.Hour}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/file", nil)
+	path := c.cachePath(req)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+metaSuffix, []byte(`{"url":"http://example.com/file","status":200,"body":"a"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _, err := c.Get(req)
+	if resp != nil || err != nil {
+		t.Errorf("Get = %v, %v, want cache miss", resp, err)
+	}
+	if _, err := os.Stat(path + metaSuffix); !os.IsNotExist(err) {
+		t.Errorf("broken entry not removed: %v", err)
+	}
+	c.Close()
+
+	// the rebuild of the index removes broken entries as well
+	if err := os.WriteFile(path+metaSuffix, []byte(`{"url":"http://example.com/file","status":200,"body":"a"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, indexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewDiskCache(Config{CacheDir: dir, EntryTTL: time.Hour}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := os.Stat(path + metaSuffix); !os.IsNotExist(err) {
+		t.Errorf("broken entry not removed by rebuild: %v", err)
+	}
+}
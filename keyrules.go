@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// KeyRule normalizes the cache key of requests to matching hosts. The original URL is still sent upstream.
+type KeyRule struct {
+	Host          string   `json:"host,omitempty"`           // host the rule applies to, wildcards like "*.example.com" allowed, empty matches all hosts
+	StripQuery    []string `json:"strip_query,omitempty"`    // query parameters removed from the key, prefixes like "X-Amz-*" allowed
+	KeepQuery     []string `json:"keep_query,omitempty"`     // if set, only these query parameters are kept in the key
+	SortQuery     bool     `json:"sort_query,omitempty"`     // whether query parameters are sorted
+	LowerHost     bool     `json:"lower_host,omitempty"`     // whether the host is lowercased
+	CanonicalHost string   `json:"canonical_host,omitempty"` // host used in the key instead of the requested one, so equivalent hosts share entries
+	PathPattern   string   `json:"path_pattern,omitempty"`   // regular expression replaced in the path
+	PathReplace   string   `json:"path_replace,omitempty"`   // replacement of PathPattern, may reference groups like $1
+
+	pathRegexp *regexp.Regexp
+}
+
+// KeyRules is a list of key rules, the first rule matching the host of a request is applied.
+type KeyRules []KeyRule
+
+// UnmarshalText decodes the rules from a JSON list and validates them.
+func (r *KeyRules) UnmarshalText(data []byte) error {
+	var rules []KeyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("key rule %d: %w", i+1, err)
+		}
+	}
+	*r = rules
+	return nil
+}
+
+// String returns the rules as JSON list.
+func (r KeyRules) String() string {
+	data, _ := json.Marshal([]KeyRule(r))
+	return string(data)
+}
+
+// compile validates the rule and compiles its path pattern.
+func (r *KeyRule) compile() error {
+	if len(r.StripQuery) > 0 && len(r.KeepQuery) > 0 {
+		return fmt.Errorf("strip_query and keep_query are exclusive")
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("invalid host glob %q: %w", r.Host, err)
+	}
+	if r.PathPattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.PathPattern)
+	if err != nil {
+		return err
+	}
+	r.pathRegexp = re
+	return nil
+}
+
+// matchHost checks if host matches the pattern, which is either a host name or a glob like "*.example.com".
+func matchHost(pattern string, host string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return ok
+}
+
+// matchParam checks if the query parameter name matches the pattern, which may end with a "*" wildcard.
+func matchParam(pattern string, name string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+	}
+	return strings.EqualFold(pattern, name)
+}
+
+// apply returns a copy of u normalized by the rule.
+func (r *KeyRule) apply(u *url.URL) *url.URL {
+	key := *u
+	switch {
+	case r.CanonicalHost != "":
+		key.Host = r.CanonicalHost
+	case r.LowerHost:
+		key.Host = strings.ToLower(key.Host)
+	}
+
+	if r.pathRegexp != nil {
+		key.Path = r.pathRegexp.ReplaceAllString(key.Path, r.PathReplace)
+		key.RawPath = ""
+	}
+
+	if key.RawQuery != "" && (len(r.StripQuery) > 0 || len(r.KeepQuery) > 0 || r.SortQuery) {
+		var params []string
+		for _, param := range strings.Split(key.RawQuery, "&") {
+			name, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			match := func(pattern string) bool { return matchParam(pattern, name) }
+			if slices.ContainsFunc(r.StripQuery, match) {
+				continue
+			}
+			if len(r.KeepQuery) > 0 && !slices.ContainsFunc(r.KeepQuery, match) {
+				continue
+			}
+			params = append(params, param)
+		}
+		if r.SortQuery {
+			slices.Sort(params)
+		}
+		key.RawQuery = strings.Join(params, "&")
+	}
+	return &key
+}
+
+// keyURL returns the URL used in the cache key of a request for u, normalized by the first matching key rule.
+func (c *DiskCache) keyURL(u *url.URL) *url.URL {
+	for i := range c.config().KeyRules {
+		rule := &c.config().KeyRules[i]
+		if rule.Host == "" || matchHost(rule.Host, u.Hostname()) {
+			return rule.apply(u)
+		}
+	}
+	return u
+}
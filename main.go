@@ -1,58 +1,60 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/gomitmproxy"
 	"github.com/AdguardTeam/gomitmproxy/mitm"
 	"github.com/AdguardTeam/gomitmproxy/proxyutil"
-	"github.com/caarlos0/env/v11"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// initMitm initializes the MITM configuration for the proxy.
-func initMitm() *mitm.Config {
-	tlsCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+// initMitm initializes the MITM configuration for the proxy. Host certificates are issued by ca.
+func initMitm(ca *certAuthority) (*mitm.Config, error) {
+	// gomitmproxy creates its own certificate if ca refuses a host, e.g. outside the name constraints. It only
+	// supports RSA keys, so it gets a key not matching the CA and fails the handshake instead.
+	fallbackKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		log.Fatal(err)
-	}
-	privateKey := tlsCert.PrivateKey.(*rsa.PrivateKey)
-
-	x509c, err := x509.ParseCertificate(tlsCert.Certificate[0])
-	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	mitmConfig, err := mitm.NewConfig(x509c, privateKey, nil)
+	mitmConfig, err := mitm.NewConfig(ca.cert, fallbackKey, ca)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	mitmConfig.SetValidity(time.Hour * 24 * 356) // generate certs valid for 1 year
-	mitmConfig.SetOrganization("gitmproxy")      // cert organization
-	return mitmConfig
+	mitmConfig.SetValidity(leafValidity)    // generate certs valid for 1 year
+	mitmConfig.SetOrganization("gitmproxy") // cert organization
+	return mitmConfig, nil
 }
 
 func main() {
 	log.Info("Starting Gopher in the middle cache proxy...")
 
-	config := env.Must(env.ParseAs[Config]())
+	configFile := os.Getenv(configFileEnv)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 	config.Print()
 
+	// upstream certificates are verified, so the cache can not be poisoned on the network path
+	upstream, err := newUpstreamTLS(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Initialize the disk cache
 	diskCache, err := NewDiskCache(config,
 		&http.Transport{
-			TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+			DialTLSContext:     upstream.DialTLSContext,
 			DisableCompression: true,
 		})
 	if err != nil {
@@ -70,13 +72,31 @@ func main() {
 	// Create an HTTP client without caching
 	noCacheClient := http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			DialTLSContext: upstream.DialTLSContext,
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
 
+	// start the admin API on its own address, so it is not reachable through the proxy
+	if config.AdminAddr != "" {
+		go func() {
+			log.Info("Admin API listening on %s", config.AdminAddr)
+			log.Fatal(http.ListenAndServe(config.AdminAddr, diskCache.AdminHandler()))
+		}()
+	}
+
+	// load or create the CA signing the certificates of intercepted hosts
+	ca, err := newCertAuthority(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mitmConfig, err := initMitm(ca)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// resolve TCP address for the proxy to listen on
 	addr, err := net.ResolveTCPAddr("tcp", config.ListenAddr)
 	if err != nil {
@@ -89,11 +109,18 @@ func main() {
 	// Initialize the proxy with the MITM configuration and request handler
 	proxy := gomitmproxy.NewProxy(gomitmproxy.Config{
 		ListenAddr: addr,
-		MITMConfig: initMitm(),
+		MITMConfig: mitmConfig,
+		OnConnect:  onConnect,
 
 		OnRequest: func(session *gomitmproxy.Session) (*http.Request, *http.Response) {
 			req := session.Request()
 			if req.Method == http.MethodConnect {
+				// pinned or sensitive hosts and hosts outside the name constraints of the CA are tunneled
+				// without interception
+				host := req.URL.Hostname()
+				if !diskCache.config().interceptHost(host) || !ca.permits(host) {
+					return connectPassthrough(session)
+				}
 				return nil, nil
 			}
 
@@ -104,6 +131,14 @@ func main() {
 				return nil, rw.Response(req)
 			}
 
+			// handle CA certificate downloads, so clients can install it through the proxy
+			switch req.URL.Path {
+			case "/_gitmproxy_ca.pem":
+				return nil, ca.caResponse(req, false)
+			case "/_gitmproxy_ca.der", "/_gitmproxy_ca.crt":
+				return nil, ca.caResponse(req, true)
+			}
+
 			// ignore requests to the proxy itself
 			if strings.HasPrefix(req.URL.Host, "127.0.0.1") || strings.HasPrefix(req.URL.Host, "localhost") {
 				// do not proxy requests to localhost or
@@ -115,8 +150,8 @@ func main() {
 			req.RequestURI = ""
 
 			var response *http.Response
-			// cache only GET requests
-			if req.Method == http.MethodGet {
+			// cache only GET requests, HEAD requests are answered from cached GET responses
+			if req.Method == http.MethodGet || req.Method == http.MethodHead {
 				response, err = cacheClient.Do(req)
 			} else {
 				response, err = noCacheClient.Do(req)
@@ -124,9 +159,8 @@ func main() {
 
 			// handle errors from the HTTP client
 			if err != nil {
-				body := strings.NewReader(err.Error())
-				res := proxyutil.NewResponse(http.StatusInternalServerError, body, req)
-				return nil, res
+				log.Printf("upstream error: %s %s: %v", req.Method, req.URL.String(), err)
+				return nil, upstreamErrorResponse(req, err)
 			}
 
 			return nil, response
@@ -137,10 +171,28 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// reload the configuration on SIGHUP or if the configuration file changes
+	configChanged := make(chan struct{})
+	if configFile != "" {
+		go watchConfigFile(configFile, configChanged)
+	}
+
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChannel
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+loop:
+	for {
+		select {
+		case sig := <-signalChannel:
+			if sig != syscall.SIGHUP {
+				break loop
+			}
+			config = reloadConfig(configFile, config, diskCache)
+		case <-configChanged:
+			config = reloadConfig(configFile, config, diskCache)
+		}
+	}
 
 	// Clean up.
 	proxy.Close()
+	diskCache.Close()
 }
@@ -23,6 +23,45 @@ var (
 		Name: "gitmproxy_cache_requests_miss_total",
 		Help: "The total number of received requests with cache miss.",
 	})
+	mCacheRequestsStaleTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gitmproxy_cache_requests_stale_total",
+		Help: "The total number of received requests served with stale cache entries.",
+	})
+	mCacheRedirectHitTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gitmproxy_cache_redirect_hits_total",
+		Help: "The total number of received requests answered with cached redirects.",
+	})
+	mCacheRedirectMissTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gitmproxy_cache_redirect_miss_total",
+		Help: "The total number of received requests answered with redirects from upstream.",
+	})
+	mCacheNegativeHitTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gitmproxy_cache_negative_hits_total",
+		Help: "The total number of received requests answered with cached 404/410 responses.",
+	})
+	mCacheNegativeMissTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gitmproxy_cache_negative_miss_total",
+		Help: "The total number of received requests answered with 404/410 responses from upstream.",
+	})
+
+	mPassthroughConnectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gitmproxy_passthrough_connections_total",
+		Help: "The total number of CONNECT requests tunneled without interception.",
+	})
+	mPassthroughConnectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gitmproxy_passthrough_connections_active",
+		Help: "The number of open CONNECT tunnels without interception.",
+	})
+
+	mCertGenerationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "gitmproxy_cert_generation_seconds",
+		Help: "Time taken to generate host certificates of intercepted connections.",
+	})
+
+	mCacheDedupSavedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gitmproxy_cache_dedup_saved_bytes",
+		Help: "Amount of disk space saved by storing identical bodies only once.",
+	})
 
 	mCacheRequestsBytes = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "gitmproxy_cache_requests_bytes",
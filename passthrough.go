@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/gomitmproxy"
+)
+
+// passthroughProp is the session property holding the upstream connection of a CONNECT request
+// that is tunneled without interception.
+const passthroughProp = "gitmproxy.passthrough"
+
+// interceptHost checks if CONNECT requests to host are intercepted. Hosts in PassthroughHosts are never
+// intercepted, if MitmHosts is set only matching hosts are intercepted.
+func (c *Config) interceptHost(host string) bool {
+	match := func(pattern string) bool { return matchHost(pattern, host) }
+	if slices.ContainsFunc(c.PassthroughHosts, match) {
+		return false
+	}
+	return len(c.MitmHosts) == 0 || slices.ContainsFunc(c.MitmHosts, match)
+}
+
+// connectPassthrough prepares the CONNECT request of session to be tunneled as raw TCP connection. The target is
+// connected here, so connection errors are answered with an error response. It returns the request passed on to
+// gomitmproxy, which tunnels requests without port instead of intercepting them, and picks up the connection
+// in passthroughConn.
+func connectPassthrough(session *gomitmproxy.Session) (*http.Request, *http.Response) {
+	req := session.Request()
+	conn, err := net.DialTimeout("tcp", req.URL.Host, 30*time.Second)
+	if err != nil {
+		log.Printf("passthrough error: %s: %v", req.URL.Host, err)
+		return nil, upstreamErrorResponse(req, err)
+	}
+	log.Printf("passthrough: %s", req.URL.Host)
+	mPassthroughConnectionsTotal.Inc()
+	mPassthroughConnectionsActive.Inc()
+	session.SetProp(passthroughProp, &passthroughConn{Conn: conn})
+
+	tunnelReq := req.Clone(req.Context())
+	tunnelReq.URL.Host = req.URL.Hostname()
+	return tunnelReq, nil
+}
+
+// onConnect returns the upstream connection of a CONNECT request prepared by connectPassthrough.
+// It is used as gomitmproxy.Config.OnConnect.
+func onConnect(session *gomitmproxy.Session, _ string, _ string) net.Conn {
+	if conn, ok := session.GetProp(passthroughProp); ok {
+		return conn.(net.Conn)
+	}
+	return nil
+}
+
+// passthroughConn is the upstream connection of a tunneled CONNECT request, which is counted as active until closed.
+type passthroughConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// Close closes the connection.
+func (c *passthroughConn) Close() error {
+	c.once.Do(mPassthroughConnectionsActive.Dec)
+	return c.Conn.Close()
+}
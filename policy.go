@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PolicyRule overrides the caching configuration for requests matching its host, path and content type.
+type PolicyRule struct {
+	Host                     string `json:"host,omitempty"`                        // host glob like "*.github.com" or "api.*", empty matches all hosts
+	Path                     string `json:"path,omitempty"`                        // regular expression matched against the URL path, empty matches all paths
+	ContentType              string `json:"content_type,omitempty"`                // glob like "image/*" matched against the response content type
+	TTL                      string `json:"ttl,omitempty"`                         // overrides EntryTTL, e.g. "720h"
+	MaxSize                  string `json:"max_size,omitempty"`                    // overrides EntryMaxSize, e.g. "2GB"
+	IgnoreServerCacheControl *bool  `json:"ignore_server_cache_control,omitempty"` // overrides IgnoreServerCacheControl
+	Bypass                   bool   `json:"bypass,omitempty"`                      // whether matching responses are never cached
+
+	pathRegexp *regexp.Regexp
+	ttl        time.Duration
+	maxSize    ByteSize
+}
+
+// PolicyRules is an ordered list of policy rules, the first matching rule is applied.
+type PolicyRules []PolicyRule
+
+// UnmarshalText decodes the rules from a JSON list and validates them.
+func (r *PolicyRules) UnmarshalText(data []byte) error {
+	var rules []PolicyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("policy rule %d: %w", i+1, err)
+		}
+	}
+	*r = rules
+	return nil
+}
+
+// String returns the rules as JSON list.
+func (r PolicyRules) String() string {
+	data, _ := json.Marshal([]PolicyRule(r))
+	return string(data)
+}
+
+// compile validates the rule and parses its patterns and values.
+func (r *PolicyRule) compile() error {
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("invalid host glob %q: %w", r.Host, err)
+	}
+	if _, err := path.Match(r.ContentType, ""); err != nil {
+		return fmt.Errorf("invalid content type glob %q: %w", r.ContentType, err)
+	}
+	if r.Path != "" {
+		re, err := regexp.Compile(r.Path)
+		if err != nil {
+			return err
+		}
+		r.pathRegexp = re
+	}
+	if r.TTL != "" {
+		ttl, err := time.ParseDuration(r.TTL)
+		if err != nil {
+			return err
+		}
+		r.ttl = ttl
+	}
+	if r.MaxSize != "" {
+		if err := r.maxSize.UnmarshalText([]byte(r.MaxSize)); err != nil {
+			return fmt.Errorf("invalid max_size %q: %w", r.MaxSize, err)
+		}
+	}
+	return nil
+}
+
+// matches checks if the rule applies to a request for u with a response of the given content type.
+// An empty content type only matches rules without a content type, as the response is not known yet.
+func (r *PolicyRule) matches(u *url.URL, contentType string) bool {
+	if r.Host != "" && !matchHost(r.Host, u.Hostname()) {
+		return false
+	}
+	if r.pathRegexp != nil && !r.pathRegexp.MatchString(u.Path) {
+		return false
+	}
+	if r.ContentType != "" {
+		mediaType, _, _ := strings.Cut(contentType, ";")
+		ok, _ := path.Match(strings.ToLower(r.ContentType), strings.ToLower(strings.TrimSpace(mediaType)))
+		return ok
+	}
+	return true
+}
+
+// cachePolicy is the caching configuration applied to a single request.
+type cachePolicy struct {
+	ttl                      time.Duration
+	maxSize                  int64
+	ignoreServerCacheControl bool
+	bypass                   bool
+}
+
+// policy returns the caching configuration for a request for u with a response of the given content type,
+// which is the global configuration overridden by the first matching policy rule.
+func (c *DiskCache) policy(u *url.URL, contentType string) cachePolicy {
+	p := cachePolicy{
+		ttl:                      c.config().EntryTTL,
+		maxSize:                  int64(c.config().EntryMaxSize),
+		ignoreServerCacheControl: c.config().IgnoreServerCacheControl,
+	}
+	for i := range c.config().PolicyRules {
+		rule := &c.config().PolicyRules[i]
+		if !rule.matches(u, contentType) {
+			continue
+		}
+		if rule.TTL != "" {
+			p.ttl = rule.ttl
+		}
+		if rule.MaxSize != "" {
+			p.maxSize = int64(rule.maxSize)
+		}
+		if rule.IgnoreServerCacheControl != nil {
+			p.ignoreServerCacheControl = *rule.IgnoreServerCacheControl
+		}
+		p.bypass = rule.Bypass
+		break
+	}
+	return p
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// errNoOverlap is returned by parseRange if none of the requested ranges overlap with the content.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// httpRange specifies the byte range to be sent to the client.
+type httpRange struct {
+	start, length int64
+}
+
+// contentRange returns the value of the Content-Range header for the range of content with the given size.
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header string as per RFC 9110 for content of the given size.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		start, end = textproto.TrimString(start), textproto.TrimString(end)
+		var r httpRange
+		if start == "" {
+			// suffix range, end is the number of bytes at the end of the content
+			if end == "" || end[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errors.New("invalid range")
+			}
+			if i > size {
+				i = size
+			}
+			if i == 0 {
+				noOverlap = true
+				continue
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches checks the If-Range header value against the validators of the response headers.
+// ETags must match strongly, dates must be equal to Last-Modified.
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := header.Get("ETag")
+		return !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(etag, "W/") && etag == ifRange
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && t.Equal(lastModified)
+}
+
+// rangeBody combines a reader for the requested ranges with the closer of the cached body.
+type rangeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// applyRange turns a complete cached response into a partial response for the given Range and If-Range
+// header values. It returns nil if the range can not be served from resp, e.g. because the body is not
+// stored in the cache or its size is unknown. In this case resp is left untouched.
+func applyRange(resp *http.Response, rangeHeader string, ifRange string) *http.Response {
+	body, ok := resp.Body.(io.ReaderAt)
+	if !ok || resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return nil
+	}
+	size := resp.ContentLength
+
+	// a failed If-Range condition means the full response is sent
+	if !ifRangeMatches(ifRange, resp.Header) {
+		return resp
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if errors.Is(err, errNoOverlap) {
+		resp.Body.Close()
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Type")
+		resp.Header.Del("Content-Length")
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+		return resp
+	}
+	if err != nil || len(ranges) == 0 {
+		// invalid ranges are ignored and the full response is sent
+		return resp
+	}
+
+	// ranges larger than the content are likely an attack, send the full response instead
+	var sum int64
+	for _, r := range ranges {
+		sum += r.length
+	}
+	if sum > size {
+		return resp
+	}
+
+	closer := resp.Body
+	resp.Header.Del("Content-Length")
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Set("Accept-Ranges", "bytes")
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		resp.Header.Set("Content-Range", r.contentRange(size))
+		resp.ContentLength = r.length
+		resp.Body = &rangeBody{Reader: io.NewSectionReader(body, r.start, r.length), Closer: closer}
+		return resp
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for _, r := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Range": {r.contentRange(size)},
+				"Content-Type":  {contentType},
+			})
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(part, io.NewSectionReader(body, r.start, r.length)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		mw.Close()
+		pw.Close()
+	}()
+
+	resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	resp.Header.Del("Content-Range")
+	resp.ContentLength = -1
+	resp.Body = &rangeBody{Reader: pr, Closer: closeFunc(func() error {
+		pr.Close()
+		return closer.Close()
+	})}
+	return resp
+}
+
+// closeFunc implements io.Closer with a function.
+type closeFunc func() error
+
+// Close calls the function. It implements the io.Closer interface.
+func (f closeFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// registryNamespace is the directory of content addressed registry entries shared by all registries.
+	registryNamespace = "_registry"
+
+	// registryMaxRedirects is the maximum number of redirects followed for a blob request.
+	registryMaxRedirects = 10
+)
+
+// digestRegexp matches content digests as defined by the OCI image specification, e.g. "sha256:<hex>".
+var digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+// registryKind is the type of registry API resource requested.
+type registryKind int
+
+const (
+	registryBlob           registryKind = iota + 1 // blob by digest
+	registryManifestDigest                         // manifest by digest
+	registryManifestTag                            // manifest by tag
+)
+
+// registryRef describes a request for a blob or manifest of the Docker/OCI registry API.
+type registryRef struct {
+	kind      registryKind
+	reference string // digest or tag
+}
+
+// parseRegistryPath parses the URL paths /v2/<name>/blobs/<digest> and /v2/<name>/manifests/<reference>.
+func parseRegistryPath(path string) (registryRef, bool) {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return registryRef{}, false
+	}
+
+	var ref registryRef
+	if i := strings.LastIndex(rest, "/blobs/"); i > 0 {
+		ref = registryRef{kind: registryBlob, reference: rest[i+len("/blobs/"):]}
+		if !digestRegexp.MatchString(ref.reference) {
+			return registryRef{}, false // e.g. blob uploads
+		}
+		return ref, true
+	}
+	if i := strings.LastIndex(rest, "/manifests/"); i > 0 {
+		ref = registryRef{kind: registryManifestTag, reference: rest[i+len("/manifests/"):]}
+		if ref.reference == "" || strings.Contains(ref.reference, "/") {
+			return registryRef{}, false
+		}
+		if digestRegexp.MatchString(ref.reference) {
+			ref.kind = registryManifestDigest
+		}
+		return ref, true
+	}
+	return registryRef{}, false
+}
+
+// registryRef returns the registry resource requested with the URL, if registry mode is enabled.
+func (c *DiskCache) registryRef(u *url.URL) (registryRef, bool) {
+	if !c.config().RegistryMode {
+		return registryRef{}, false
+	}
+	return parseRegistryPath(u.Path)
+}
+
+// registryKey returns the directory and the key of the cache entry for a registry request. Blobs and manifests
+// by digest are identified by their digest only, so they are shared between registries and repositories.
+// Manifests by tag also depend on the media types the client accepts.
+func (c *DiskCache) registryKey(req *http.Request) (string, string, bool) {
+	ref, ok := c.registryRef(req.URL)
+	if !ok {
+		return "", "", false
+	}
+	switch ref.kind {
+	case registryBlob:
+		return registryNamespace, req.Method + " blob " + ref.reference, true
+	case registryManifestDigest:
+		return registryNamespace, req.Method + " manifest " + ref.reference, true
+	}
+	return req.URL.Hostname(), req.Method + req.URL.String() + "\n" + strings.Join(req.Header.Values("Accept"), ","), true
+}
+
+// verifyDigest checks that a registry blob or manifest requested by a sha256 digest has the SHA-256 hash
+// of the body. Other digest algorithms are not verified.
+func (c *DiskCache) verifyDigest(u *url.URL, hash string) error {
+	ref, ok := c.registryRef(u)
+	if !ok || ref.kind == registryManifestTag {
+		return nil
+	}
+	if digest, ok := strings.CutPrefix(ref.reference, "sha256:"); ok && !strings.EqualFold(digest, hash) {
+		return fmt.Errorf("digest mismatch: body has sha256:%s", hash)
+	}
+	return nil
+}
+
+// registryExpires sets the expiry of a registry blob or manifest: content addressed by digest never changes,
+// tags are revalidated after RegistryTagTTL. Returns false if the entry is no registry content.
+func (c *DiskCache) registryExpires(entry *cacheEntry) bool {
+	u, err := url.Parse(entry.URL)
+	if err != nil || entry.StatusCode != http.StatusOK {
+		return false
+	}
+	ref, ok := c.registryRef(u)
+	if !ok {
+		return false
+	}
+
+	entry.Expires = time.Time{}
+	if ref.kind == registryManifestTag && c.config().RegistryTagTTL > 0 {
+		entry.Expires = entry.Stored.Add(c.config().RegistryTagTTL)
+	}
+	return true
+}
+
+// isRegistryPassthrough checks if req is part of the registry API or authentication flow that must not be cached,
+// e.g. the version check, tag lists or token requests.
+func (c *DiskCache) isRegistryPassthrough(req *http.Request) bool {
+	if !c.config().RegistryMode {
+		return false
+	}
+	if strings.HasPrefix(req.URL.Path, "/v2/") || req.URL.Path == "/v2" {
+		_, ok := parseRegistryPath(req.URL.Path)
+		return !ok
+	}
+	query := req.URL.Query()
+	return query.Has("scope") || query.Has("service") || strings.HasSuffix(req.URL.Path, "/token")
+}
+
+// registryTransport follows the redirects of blob requests if registry mode is enabled, so blobs are downloaded
+// and cached under their digest instead of passing signed, short-lived storage URLs to the client.
+type registryTransport struct {
+	next  http.RoundTripper
+	cache *DiskCache
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if ref, ok := t.cache.registryRef(req.URL); !ok || ref.kind != registryBlob {
+		return resp, nil
+	}
+
+	for i := 0; isPermanentRedirect(resp.StatusCode) || isTemporaryRedirect(resp.StatusCode); i++ {
+		location, err := resp.Location()
+		if err != nil {
+			return resp, nil // nothing to follow
+		}
+		resp.Body.Close()
+		if i == registryMaxRedirects {
+			return nil, errors.New("registry blob: too many redirects")
+		}
+
+		redirectReq := req.Clone(req.Context())
+		redirectReq.URL = location
+		redirectReq.Host = ""
+		if location.Host != req.URL.Host {
+			// storage backends reject or must not see the registry token
+			redirectReq.Header.Del("Authorization")
+		}
+		resp, err = t.next.RoundTrip(redirectReq)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// partialSuffix is the suffix of the file holding the state of an interrupted download in the temporary directory.
+	partialSuffix = ".partial"
+
+	// partialMaxAge is the time after which interrupted downloads that were never resumed are removed on startup.
+	partialMaxAge = 7 * 24 * time.Hour
+)
+
+// partialDownload is the state of an interrupted download, stored next to the temporary body file.
+type partialDownload struct {
+	Entry  cacheEntry `json:"entry"`
+	Length int64      `json:"length"` // total length announced by upstream, -1 if unknown
+
+	size int64 // bytes already downloaded
+}
+
+// resumeValidator returns the validator used in the If-Range header to resume a download of a response with
+// the given headers. An empty string is returned if the response can not be resumed safely.
+func resumeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// resumeRequest returns a request for the remaining bytes of req starting at offset.
+func resumeRequest(req *http.Request, validator string, offset int64) *http.Request {
+	resumeReq := req.Clone(req.Context())
+	resumeReq.Header.Del("If-None-Match")
+	resumeReq.Header.Del("If-Modified-Since")
+	resumeReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resumeReq.Header.Set("If-Range", validator)
+	return resumeReq
+}
+
+// resumeMatches checks if resp is a partial response continuing a download of the given total length at offset.
+// A length of -1 accepts any total length.
+func resumeMatches(resp *http.Response, offset int64, length int64) bool {
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+
+	// Content-Range: bytes <start>-<end>/<total>
+	value, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return false
+	}
+	rng, total, ok := strings.Cut(value, "/")
+	if !ok {
+		return false
+	}
+	start, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return false
+	}
+	if s, err := strconv.ParseInt(start, 10, 64); err != nil || s != offset {
+		return false
+	}
+	if length < 0 || total == "*" {
+		return true
+	}
+	t, err := strconv.ParseInt(total, 10, 64)
+	return err == nil && t == length
+}
+
+// resume requests the remaining bytes of the download for req starting at offset.
+// An error is returned if upstream can not continue the download.
+func (c *DiskCache) resume(req *http.Request, validator string, offset int64, length int64) (*http.Response, error) {
+	resp, err := c.transport.RoundTrip(resumeRequest(req, validator, offset))
+	if err != nil {
+		return nil, err
+	}
+	if !resumeMatches(resp, offset, length) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream can not resume at offset %d: %s", offset, resp.Status)
+	}
+	return resp, nil
+}
+
+// savePartial stores the state of the interrupted download of the entry at path, so it can be resumed later.
+func (c *DiskCache) savePartial(path string, entry *cacheEntry, length int64) error {
+	data, err := json.Marshal(partialDownload{Entry: *entry, Length: length})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.tmpPath(path, partialSuffix), data, 0644)
+}
+
+// loadPartial returns the state of an interrupted download of the entry at path, nil if there is none.
+func (c *DiskCache) loadPartial(path string) *partialDownload {
+	data, err := os.ReadFile(c.tmpPath(path, partialSuffix))
+	if err != nil {
+		return nil
+	}
+	var partial partialDownload
+	if err := json.Unmarshal(data, &partial); err != nil {
+		c.removePartial(path)
+		return nil
+	}
+	info, err := os.Stat(c.tmpPath(path, bodySuffix))
+	if err != nil || info.Size() == 0 {
+		c.removePartial(path)
+		return nil
+	}
+	partial.size = info.Size()
+	return &partial
+}
+
+// removePartial removes the state of an interrupted download of the entry at path.
+func (c *DiskCache) removePartial(path string) {
+	os.Remove(c.tmpPath(path, partialSuffix))
+}
+
+// cleanTmpDir removes temporary files of unfinished downloads that can not be resumed.
+func (c *DiskCache) cleanTmpDir() error {
+	files, err := os.ReadDir(c.tmpDir)
+	if err != nil {
+		return err
+	}
+
+	// the body and state of a download are named <base>.body.tmp and <base>.partial.tmp
+	resumable := 0
+	for _, file := range files {
+		name := file.Name()
+		base, ok := strings.CutSuffix(name, partialSuffix+tmpSuffix)
+		if !ok {
+			if base, ok = strings.CutSuffix(name, bodySuffix+tmpSuffix); !ok {
+				os.Remove(filepath.Join(c.tmpDir, name))
+				continue
+			}
+		}
+		bodyPath := filepath.Join(c.tmpDir, base+bodySuffix+tmpSuffix)
+		partialPath := filepath.Join(c.tmpDir, base+partialSuffix+tmpSuffix)
+
+		info, err := os.Stat(partialPath)
+		_, bodyErr := os.Stat(bodyPath)
+		if err != nil || bodyErr != nil || time.Since(info.ModTime()) > partialMaxAge {
+			os.Remove(bodyPath)
+			os.Remove(partialPath)
+		} else if name == base+partialSuffix+tmpSuffix {
+			resumable++
+		}
+	}
+
+	if c.config().EnableLogging && resumable > 0 {
+		log.Info("%d interrupted downloads can be resumed", resumable)
+	}
+	return nil
+}
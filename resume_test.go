@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResumeAfterRestart(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		if first {
+			// send a part of the body and drop the connection
+			w.Header().Set("Content-Length", "100000")
+			w.Write(data[:30000])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	config := Config{CacheDir: t.TempDir(), EntryTTL: time.Hour}
+	c, err := NewDiskCache(config, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/big", nil)
+	resp, err := c.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// wait for the state of the interrupted download
+	tmpDir := filepath.Join(config.CacheDir, tmpDirName)
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasFileWithSuffix(t, tmpDir, partialSuffix+tmpSuffix) {
+		if time.Now().After(deadline) {
+			t.Fatal("interrupted download not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+
+	c, err = NewDiskCache(config, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !hasFileWithSuffix(t, tmpDir, partialSuffix+tmpSuffix) || !hasFileWithSuffix(t, tmpDir, bodySuffix+tmpSuffix) {
+		t.Fatal("interrupted download removed on startup")
+	}
+
+	resp, err = c.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Errorf("body has %d bytes, want %d", len(body), len(data))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 2 || ranges[1] != "bytes=30000-" {
+		t.Errorf("upstream requests with ranges %q, want resume at bytes=30000-", ranges)
+	}
+}
+
+// hasFileWithSuffix checks if dir contains a file with the given suffix.
+func hasFileWithSuffix(t *testing.T, dir string, suffix string) bool {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), suffix) {
+			return true
+		}
+	}
+	return false
+}
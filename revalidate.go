@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// addValidators adds the conditional headers for a revalidation of a cached response with the given headers to req.
+func addValidators(req *http.Request, header http.Header) {
+	if etag := header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// mergeHeaders updates the stored headers with the headers of a 304 response as required by RFC 9111 section 3.2.
+// Header fields describing the stored body and hop-by-hop fields are kept unchanged.
+func mergeHeaders(stored http.Header, updated http.Header) {
+	for name, values := range updated {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding", "Trailer",
+			"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Te", "Upgrade":
+			continue
+		}
+		stored[name] = slices.Clone(values)
+	}
+}
+
+// refreshEntry merges the headers of a 304 response into the entry at path and marks it as revalidated now.
+// An error satisfying os.IsNotExist is returned if there is no such entry.
+func (c *DiskCache) refreshEntry(path string, header http.Header) error {
+	// the body must not be removed from the body store while the entry is updated
+	c.bodyMu.Lock()
+	defer c.bodyMu.Unlock()
+
+	entry, oldSize, err := readEntry(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(c.bodyPath(path, entry))
+	if err != nil {
+		return err
+	}
+	entry.size = info.Size()
+
+	mergeHeaders(entry.Header, header)
+	entry.Stored = time.Now()
+	c.setExpires(entry)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// replace the metadata atomically, so readers never see a partially written file
+	tmpPath := c.tmpPath(path, metaSuffix)
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path+metaSuffix); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	c.subSize(oldSize)
+	c.addSize(int64(len(data)))
+	c.index.set(path, c.newIndexEntry(entry, int64(len(data))))
+	return nil
+}
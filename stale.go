@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/dustin/go-humanize"
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// Warning header values (RFC 7234 section 5.5) added to stale responses.
+const (
+	warningStale              = `110 gitmproxy "Response is Stale"`
+	warningRevalidationFailed = `111 gitmproxy "Revalidation Failed"`
+	warningDisconnected       = `112 gitmproxy "Disconnected Operation"`
+)
+
+// isServerError returns true for status codes that allow serving stale responses according to RFC 5861.
+func isServerError(statusCode int) bool {
+	switch statusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// staleIfError returns how long after expiry a response with the given headers may be served for req if
+// upstream fails (RFC 5861). The stale-if-error directives of the request and response take precedence over
+// the configured default, which is not applied to responses that must be revalidated.
+func (c *DiskCache) staleIfError(req *http.Request, header http.Header) time.Duration {
+	var window time.Duration
+	directive := false
+
+	if reqDir, err := cacheobject.ParseRequestCacheControl(req.Header.Get("Cache-Control")); err == nil && reqDir.StaleIfError > 0 {
+		window = time.Duration(reqDir.StaleIfError) * time.Second
+		directive = true
+	}
+
+	respDir, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	if err != nil {
+		return window
+	}
+	if respDir.StaleIfError >= 0 {
+		window = max(window, time.Duration(respDir.StaleIfError)*time.Second)
+		directive = true
+	}
+	if !directive && !respDir.MustRevalidate && !respDir.ProxyRevalidate {
+		window = c.config().StaleIfError
+	}
+	return window
+}
+
+// staleWhileRevalidate returns how long after expiry a response with the given headers may be served while
+// it is revalidated in the background (RFC 5861). The stale-while-revalidate directive of the response takes
+// precedence over the configured default, which is not applied to responses that must be revalidated.
+func (c *DiskCache) staleWhileRevalidate(header http.Header) time.Duration {
+	respDir, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	if err != nil {
+		return 0
+	}
+	if respDir.StaleWhileRevalidate >= 0 {
+		return time.Duration(respDir.StaleWhileRevalidate) * time.Second
+	}
+	if respDir.MustRevalidate || respDir.ProxyRevalidate {
+		return 0
+	}
+	return c.config().StaleWhileRevalidate
+}
+
+// revalidate starts a background revalidation of the expired entry for req with the given headers.
+// Without headers the response is downloaded. Nothing is done if a download of the entry is already in progress.
+func (c *DiskCache) revalidate(req *http.Request, inflightKey string, header http.Header) {
+	// detach from the client request, so the revalidation is not canceled with it
+	bgReq := req.Clone(context.Background())
+	addValidators(bgReq, header)
+	c.downloadInBackground(bgReq, inflightKey)
+}
+
+// downloadInBackground downloads the response for req into the cache without a client reading it.
+// Nothing is done if a download of the entry is already in progress.
+func (c *DiskCache) downloadInBackground(req *http.Request, inflightKey string) {
+	c.downloadMu.Lock()
+	if _, ok := c.inflight[inflightKey]; ok {
+		c.downloadMu.Unlock()
+		return
+	}
+	dl := newDownload()
+	c.inflight[inflightKey] = dl
+	c.downloadMu.Unlock()
+
+	go func() {
+		resp, err := c.doSingleflightDownload(req, inflightKey, dl)
+		if err != nil {
+			if c.config().EnableLogging {
+				log.Printf("cache BACKGROUND download failed: %s %s: %v", req.Method, req.URL.String(), err)
+			}
+			return
+		}
+		// a streamed response is still written to the cache after the body is closed
+		resp.Body.Close()
+	}()
+}
+
+// markStale adds the Age and Warning headers to the response of the entry that is served stale.
+func markStale(resp *http.Response, entry *cacheEntry, warning string) {
+	resp.Header.Set("Age", strconv.FormatInt(int64(entry.age().Seconds()), 10))
+	resp.Header.Add("Warning", warning)
+}
+
+// getStale returns the expired cached response for req and its entry if it expired less than window ago, else nil.
+// It is used if the revalidation or download of an expired entry failed with reason.
+func (c *DiskCache) getStale(req *http.Request, window time.Duration, reason string) (*http.Response, *cacheEntry) {
+	resp, entry, err := c.Get(req)
+	if err != nil || resp == nil {
+		return nil, nil
+	}
+	if entry.staleFor() > window {
+		resp.Body.Close()
+		return nil, nil
+	}
+
+	if c.config().EnableLogging {
+		log.Printf("cache STALE: %s %s %s (%s)", req.Method, req.URL.String(), humanize.Bytes(uint64(entry.size)), reason)
+	}
+	markStale(resp, entry, warningRevalidationFailed)
+	mCacheRequestsStaleTotal.Inc()
+	return resp, entry
+}
+
+// upstreamFailure describes why the upstream response can not be used, empty if it can be used.
+func upstreamFailure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if resp != nil && isServerError(resp.StatusCode) {
+		return fmt.Sprintf("upstream status %s", resp.Status)
+	}
+	return ""
+}
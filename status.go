@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// isPermanentRedirect returns true for redirects that are cached for PermanentRedirectTTL.
+func isPermanentRedirect(statusCode int) bool {
+	return statusCode == http.StatusMovedPermanently || statusCode == http.StatusPermanentRedirect
+}
+
+// isTemporaryRedirect returns true for redirects that are only cached with explicit freshness information.
+func isTemporaryRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+		return true
+	}
+	return false
+}
+
+// isNegative returns true for responses stating that a resource does not exist, which are cached for NegativeTTL.
+func isNegative(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusGone
+}
+
+// cacheableStatus checks if a response with the given status code and headers may be stored in the cache.
+func (c *DiskCache) cacheableStatus(statusCode int, header http.Header) bool {
+	switch {
+	case statusCode == http.StatusOK:
+		return true
+	case isPermanentRedirect(statusCode):
+		return c.config().PermanentRedirectTTL > 0
+	case isTemporaryRedirect(statusCode):
+		if !c.config().CacheTemporaryRedirects || c.config().IgnoreServerCacheControl {
+			return false
+		}
+		lifetime, ok := explicitLifetime(header, time.Now())
+		return ok && lifetime > 0
+	case isNegative(statusCode):
+		return c.config().NegativeTTL > 0
+	}
+	return false
+}
+
+// countHit updates the metrics, the activity log and the hit count of entry for req answered from the cache
+// with resp. result is HIT or STALE. entry is nil for HEAD requests and responses of running downloads.
+func (c *DiskCache) countHit(req *http.Request, resp *http.Response, entry *cacheEntry, result string) {
+	if entry != nil {
+		c.index.hit(entry.path)
+	}
+	mCacheRequestsTotal.Inc()
+	mCacheRequestsHitTotal.Inc()
+	switch {
+	case isPermanentRedirect(resp.StatusCode) || isTemporaryRedirect(resp.StatusCode):
+		mCacheRedirectHitTotal.Inc()
+	case isNegative(resp.StatusCode):
+		mCacheNegativeHitTotal.Inc()
+	}
+	c.activity.record(req, resp, result, true)
+}
+
+// countMiss updates the metrics and the activity log for req answered by upstream with resp.
+// result is MISS, EXPIRED or REVALIDATE.
+func (c *DiskCache) countMiss(req *http.Request, resp *http.Response, result string) {
+	mCacheRequestsTotal.Inc()
+	mCacheRequestsMissTotal.Inc()
+	switch {
+	case isPermanentRedirect(resp.StatusCode) || isTemporaryRedirect(resp.StatusCode):
+		mCacheRedirectMissTotal.Inc()
+	case isNegative(resp.StatusCode):
+		mCacheNegativeMissTotal.Inc()
+	}
+	c.activity.record(req, resp, result, false)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/gomitmproxy/proxyutil"
+)
+
+// upstreamTLS establishes TLS connections to upstream servers. Certificates are verified against the system pool
+// and the bundles in UpstreamCAFiles, except for hosts in InsecureHosts.
+type upstreamTLS struct {
+	roots         *x509.CertPool
+	insecureHosts []string
+	dialer        net.Dialer
+}
+
+// newUpstreamTLS loads the trusted CAs of the configuration.
+func newUpstreamTLS(config *Config) (*upstreamTLS, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	for _, file := range config.UpstreamCAFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("upstream CA bundle: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("upstream CA bundle %s: no certificates found", file)
+		}
+	}
+	return &upstreamTLS{
+		roots:         roots,
+		insecureHosts: slices.Clone(config.InsecureHosts),
+		dialer:        net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}, nil
+}
+
+// insecure checks if the certificate of host is not verified.
+func (u *upstreamTLS) insecure(host string) bool {
+	return slices.ContainsFunc(u.insecureHosts, func(pattern string) bool { return matchHost(pattern, host) })
+}
+
+// DialTLSContext connects to addr and performs the TLS handshake. It is used as http.Transport.DialTLSContext.
+func (u *upstreamTLS) DialTLSContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := u.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		RootCAs:            u.roots,
+		InsecureSkipVerify: u.insecure(host),
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// upstreamErrorResponse returns the 502 error page for req that failed with err. Certificate verification
+// failures are described with the hints to trust the server.
+func upstreamErrorResponse(req *http.Request, err error) *http.Response {
+	title := "Upstream request failed"
+	var hint string
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		title = "Upstream certificate verification failed"
+		err = certErr.Err
+		hint = fmt.Sprintf("The certificate of %s is not trusted. If this is an internal service with a self-signed "+
+			"certificate, add its CA to UPSTREAM_CA_FILES or the host to INSECURE_HOSTS.", req.URL.Hostname())
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body>\n", title)
+	fmt.Fprintf(&body, "<h1>%s</h1>\n<p>%s</p>\n<pre>%s</pre>\n",
+		title, html.EscapeString(req.URL.String()), html.EscapeString(err.Error()))
+	if hint != "" {
+		fmt.Fprintf(&body, "<p>%s</p>\n", html.EscapeString(hint))
+	}
+	body.WriteString("</body></html>\n")
+
+	resp := proxyutil.NewResponse(http.StatusBadGateway, strings.NewReader(body.String()), req)
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
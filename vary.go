@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// varySuffix is the suffix of the file listing the request headers a cached URL varies on.
+const varySuffix = ".vary"
+
+// varyHeaders returns the sorted canonical names of the request headers listed in the Vary header.
+// The second return value is true if the response varies on everything ("Vary: *").
+func varyHeaders(header http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, true
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), false
+}
+
+// variantPath returns the path of the variant of the entry at path that is selected by the values of the
+// request headers in vary. If vary is empty, path is returned unchanged.
+func variantPath(path string, vary []string, req *http.Request) string {
+	if len(vary) == 0 {
+		return path
+	}
+
+	h := fnv.New128a()
+	for _, name := range vary {
+		// normalize values, so differences in whitespace do not create new variants
+		values := slices.Clone(req.Header.Values(name))
+		for i, value := range values {
+			parts := strings.Split(value, ",")
+			for j := range parts {
+				parts[j] = strings.TrimSpace(parts[j])
+			}
+			values[i] = strings.Join(parts, ",")
+		}
+
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(strings.Join(values, ",")))
+		h.Write([]byte{0})
+	}
+	return path + "-" + hex.EncodeToString(h.Sum(nil))
+}
+
+// readVary returns the request headers the cached URL at path varies on, nil if it does not vary.
+func readVary(path string) []string {
+	data, err := os.ReadFile(path + varySuffix)
+	if err != nil {
+		return nil
+	}
+	var vary []string
+	if err := json.Unmarshal(data, &vary); err != nil {
+		return nil
+	}
+	return vary
+}
+
+// writeVary stores the request headers the cached URL at path varies on. An empty list removes the file.
+func writeVary(path string, vary []string) error {
+	if len(vary) == 0 {
+		err := os.Remove(path + varySuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if slices.Equal(readVary(path), vary) {
+		return nil
+	}
+	data, err := json.Marshal(vary)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+varySuffix, data, 0644)
+}